@@ -20,6 +20,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/sapcc/csi-driver-image-extractor/pkg/image"
@@ -43,7 +44,47 @@ func main() {
 	flag.StringVar(&cfg.DriverName, "drivername", "image.csi.cnmp.sap", "name of the driver")
 	flag.StringVar(&cfg.NodeID, "nodeid", "", "node id")
 	flag.StringVar(&cfg.ImageStoreDir, "imagestoredir", "", "image store directory")
+	flag.StringVar(&cfg.StoreMode, "storemode", "shared", "shared, if the image store is a volume shared by all nodes, or local, if it is node-local")
+	flag.Int64Var(&cfg.StoreCapacity, "storecapacity", 0, "bytes the extracted images may use in the image store, least recently used images are removed beyond (0 is unlimited)")
+	flag.Float64Var(&cfg.ExpansionRatio, "expansionratio", 2, "estimated ratio of the size of an extracted layer to its compressed size, used to check the free space of the store before a pull")
+	flag.StringVar(&cfg.LocalCacheDir, "localcachedir", "", "node-local directory caching extracted images of the shared store")
+	flag.Int64Var(&cfg.LocalCacheCapacity, "localcachecapacity", 0, "bytes the local cache may use, least recently used images are removed beyond")
 	flag.DurationVar(&cfg.MaxPublishDuration, "maxpublishduration", 3*time.Hour, "maximum time to wait ")
+	flag.StringVar(&cfg.LockBackend, "lockbackend", "file", "backend locking pulls: file in the image store, or lease in the API server")
+	flag.StringVar(&cfg.LockNamespace, "locknamespace", "default", "namespace of the leases of the lease lock backend")
+	flag.DurationVar(&cfg.LockTTL, "lockttl", time.Minute, "time after the last heartbeat of its owner a pull lock is taken over by another node")
+	flag.DurationVar(&cfg.GCRetention, "gcretention", 0, "remove extracted images not used for this duration, unless pinned by a volume or snapshot (0 disables garbage collection)")
+	flag.DurationVar(&cfg.GCInterval, "gcinterval", time.Hour, "interval of the garbage collection")
+	flag.StringVar(&cfg.TagUpdatePolicy, "tagupdatepolicy", "Wait", "default policy for new pods while the new digest of a moved tag is pulled: Wait for it, or ServePrevious digest")
+	flag.StringVar(&cfg.PullPolicy, "pullpolicy", "IfNotPresent", "default policy for resolving tags against the registry: Always, IfNotPresent or Never")
+	flag.DurationVar(&cfg.ResolveCacheTTL, "resolvecachettl", 5*time.Minute, "time a cached resolution of a tag is used with pull policy IfNotPresent")
+	flag.DurationVar(&cfg.ResolveTimeout, "resolvetimeout", 30*time.Second, "timeout of a request of the digest or the manifest of an image to the registry")
+	flag.DurationVar(&cfg.DownloadTimeout, "downloadtimeout", 0, "timeout of an attempt to download the blobs of an image (0 is unlimited)")
+	flag.DurationVar(&cfg.ExtractTimeout, "extracttimeout", 0, "timeout of the extraction of the layers of an image (0 is unlimited)")
+	flag.BoolVar(&cfg.TrustDigestReferences, "trustdigestreferences", false, "accept images referenced by digest without any registry roundtrip")
+	flag.IntVar(&cfg.ControllerWorkers, "controllerworkers", 2, "number of images extracted in parallel by CreateVolume")
+	flag.IntVar(&cfg.MaxPulls, "maxpulls", 4, "number of images pulled in parallel by the driver")
+	flag.IntVar(&cfg.PullRetries, "pullretries", 4, "number of retries of a pull failing with a transient error, e.g. a network error or a 5xx or 429 response of the registry")
+	flag.DurationVar(&cfg.PullBackoff, "pullbackoff", 10*time.Second, "delay before the first retry of a pull, doubled for every further retry")
+	flag.DurationVar(&cfg.NegativeCacheTTL, "negativecachettl", 5*time.Minute, "time a permanent pull or resolution failure, e.g. an unknown manifest or missing authorization, is returned without pulling again (0 disables the negative cache)")
+	flag.IntVar(&cfg.MaxRegistryPulls, "maxregistrypulls", 2, "number of images pulled in parallel from the same registry")
+
+	flag.Func("warmimages", "comma separated list of images pulled into the store at startup", func(value string) error {
+		for _, image := range strings.Split(value, ",") {
+			if image = strings.TrimSpace(image); image != "" {
+				cfg.WarmImages = append(cfg.WarmImages, image)
+			}
+		}
+		return nil
+	})
+	flag.StringVar(&cfg.WarmImagesFile, "warmimagesfile", "", "file listing images pulled into the store at startup, one per line")
+	flag.DurationVar(&cfg.WarmInterval, "warminterval", time.Hour, "interval in which the warm images are resolved again")
+	flag.DurationVar(&cfg.PrefetchInterval, "prefetchinterval", 0, "interval in which frequently requested tags are resolved and new digests prefetched (0 disables prefetching)")
+	flag.DurationVar(&cfg.PrefetchWindow, "prefetchwindow", 24*time.Hour, "window of the request history considered for prefetching")
+	flag.IntVar(&cfg.PrefetchMinRequests, "prefetchminrequests", 10, "minimum number of requests within the prefetch window to prefetch an image")
+	flag.IntVar(&cfg.PrefetchConcurrency, "prefetchconcurrency", 1, "number of images prefetched in parallel")
+	flag.Int64Var(&cfg.PrefetchBudget, "prefetchbudget", 0, "bytes the prefetcher may pull per prefetch interval, images exceeding the remaining budget are skipped (0 is unlimited)")
+	flag.StringVar(&cfg.AdminAddress, "adminaddress", "", "address of the admin interface serving /metrics and /pulls, e.g. :9808 (empty disables it)")
 
 	flag.Parse()
 
@@ -7,12 +7,20 @@
 
 # The script assumes that kubectl is available on the OS path 
 # where it is executed.
+#
+# Pass "local" as first argument to deploy the variant using a
+# node-local store instead of a shared PersistentVolume.
 
 set -e
 set -o pipefail
 
 BASE_DIR=$(dirname "$0")
 
+DEPLOY_DIR=${BASE_DIR}/kubernetes-latest
+if [ "$1" == "local" ]; then
+  DEPLOY_DIR=${BASE_DIR}/kubernetes-latest-local
+fi
+
 # deploy image plugin and registrar sidecar
 echo "deploying csi-driver-image-extractor components"
-kubectl apply -f ${BASE_DIR}/kubernetes-latest
+kubectl apply -f ${DEPLOY_DIR}
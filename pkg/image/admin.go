@@ -0,0 +1,72 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// runAdminServer serves the metrics of the driver on /metrics and the pulls
+// in progress on /pulls.
+func (ie *ImageExtractor) runAdminServer() {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		&pullCollector{ie: ie},
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/pulls", ie.servePulls)
+
+	glog.Infof("Serving admin interface on %s", ie.config.AdminAddress)
+	if err := http.ListenAndServe(ie.config.AdminAddress, mux); err != nil {
+		glog.Errorf("serving admin interface failed %s", err.Error())
+	}
+}
+
+// servePulls lists the pulls in progress of all drivers sharing the store.
+// The progress of the pulls of this driver is the latest sample, the progress
+// of other pulls is as of the last heartbeat of their owner.
+func (ie *ImageExtractor) servePulls(w http.ResponseWriter, r *http.Request) {
+	pulls, err := ie.pullLocker.list(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range pulls {
+		if pulls[i].Owner != ie.config.NodeID {
+			continue
+		}
+		if job := ie.getPullJob(&ContainerImage{Digest: pulls[i].Digest}); job != nil {
+			pulls[i].Progress = job.tracker.getLastProgress()
+		}
+	}
+	if pulls == nil {
+		pulls = []pullStatus{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pulls); err != nil {
+		glog.V(4).Infof("writing pulls failed %s\n", err.Error())
+	}
+}
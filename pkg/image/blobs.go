@@ -0,0 +1,151 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// The blob store keeps the blobs downloaded by pulls, so that blobs shared by
+// several images are downloaded once. Blobs are hard linked into the OCI
+// layout of a copy before skopeo runs, which skips the blobs present. Every
+// extraction using a blob holds a reference on it in
+// blobref/<algorithm>-<hex>/<digest of the extraction>, blobs without
+// references are removed by the garbage collection.
+
+func getBlobPath(blob digest.Digest) string {
+	return path.Join(blobDir, blob.Algorithm().String(), blob.Encoded())
+}
+
+func getBlobRefDir(blob digest.Digest) string {
+	return path.Join(blobRefDir, blob.Algorithm().String()+"-"+blob.Encoded())
+}
+
+// getManifestBlobs returns the config and the layers of the manifest.
+func getManifestBlobs(imageManifest manifest.Manifest) []digest.Digest {
+	blobs := []digest.Digest{imageManifest.ConfigInfo().Digest}
+	for _, layer := range imageManifest.LayerInfos() {
+		blobs = append(blobs, layer.Digest)
+	}
+	return blobs
+}
+
+// seedCopy links the blobs of the store into the OCI layout of the copy.
+func seedCopy(copyDir string, blobs []digest.Digest) {
+	for _, blob := range blobs {
+		layoutPath := getLayoutBlobPath(copyDir, blob)
+		if _, err := os.Stat(layoutPath); err == nil {
+			continue
+		}
+		if _, err := os.Stat(getBlobPath(blob)); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(layoutPath), os.ModePerm); err != nil {
+			glog.V(4).Infof("creating dir %s failed %s\n", path.Dir(layoutPath), err.Error())
+			return
+		}
+		if err := os.Link(getBlobPath(blob), layoutPath); err != nil && !os.IsExist(err) {
+			glog.V(4).Infof("linking blob %s failed %s\n", blob, err.Error())
+			continue
+		}
+		glog.V(5).Infof("reusing blob %s\n", blob)
+	}
+}
+
+// storeBlobs links the blobs of the copy into the store and references them
+// by the image. Skopeo verified the blobs while copying.
+func (image ContainerImage) storeBlobs(copyDir string, blobs []digest.Digest) error {
+	for _, blob := range blobs {
+		refDir := getBlobRefDir(blob)
+		if err := os.MkdirAll(refDir, os.ModePerm); err != nil {
+			return err
+		}
+		if err := touchFile(path.Join(refDir, image.Digest), true); err != nil {
+			return err
+		}
+
+		blobPath := getBlobPath(blob)
+		if err := os.MkdirAll(path.Dir(blobPath), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Link(getLayoutBlobPath(copyDir, blob), blobPath); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBlobReferences removes the references of the extraction of the digest.
+func removeBlobReferences(digest string) {
+	entries, err := os.ReadDir(blobRefDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		os.Remove(path.Join(blobRefDir, entry.Name(), digest))
+	}
+}
+
+// removeUnreferencedBlobs removes the blobs of the store, which are not
+// referenced by any extraction. References of pulls, which have not been
+// completed within the maximum publish duration, are removed before.
+func (ie *ImageExtractor) removeUnreferencedBlobs() {
+	algorithms, err := os.ReadDir(blobDir)
+	if err != nil {
+		return
+	}
+	for _, algorithm := range algorithms {
+		blobs, err := os.ReadDir(path.Join(blobDir, algorithm.Name()))
+		if err != nil {
+			continue
+		}
+		for _, entry := range blobs {
+			blob := digest.NewDigestFromEncoded(digest.Algorithm(algorithm.Name()), entry.Name())
+			if ie.countBlobReferences(blob) > 0 {
+				continue
+			}
+			glog.V(4).Infof("removing unreferenced blob %s\n", blob)
+			os.Remove(getBlobPath(blob))
+			os.Remove(getBlobRefDir(blob))
+		}
+	}
+}
+
+func (ie *ImageExtractor) countBlobReferences(blob digest.Digest) int {
+	refDir := getBlobRefDir(blob)
+	refs, err := os.ReadDir(refDir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, ref := range refs {
+		info, err := ref.Info()
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path.Join(extractDir, ref.Name())); os.IsNotExist(err) && time.Since(info.ModTime()) > ie.config.MaxPublishDuration {
+			os.Remove(path.Join(refDir, ref.Name()))
+			continue
+		}
+		count++
+	}
+	return count
+}
@@ -0,0 +1,162 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Pulls are checkpointed in the store, so that a pull interrupted on any node
+// continues from the last complete layer. The copy directory of a digest is an
+// OCI layout, skopeo keeps the blobs already downloaded and verified there and
+// fetches the missing ones only. Layers applied to the extraction in the temp
+// directory are recorded in the checkpoint file next to it. Both are protected
+// by the pull lock of the image.
+
+// extractionCheckpoint records the layers applied to the extraction in the
+// temp directory.
+type extractionCheckpoint struct {
+	Digest string   `json:"digest"`
+	Layers []string `json:"layers"`
+}
+
+func (image ContainerImage) getExtractTempDestination() string {
+	return path.Join(tempDir, image.getPullKey())
+}
+
+func (image ContainerImage) getCheckpointFileName() string {
+	return path.Join(tempDir, image.getPullKey()+"+layers")
+}
+
+func (image ContainerImage) readCheckpoint() (*extractionCheckpoint, error) {
+	content, err := os.ReadFile(image.getCheckpointFileName())
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint extractionCheckpoint
+	if err := json.Unmarshal(content, &checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (image ContainerImage) writeCheckpoint(checkpoint *extractionCheckpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	fileName := image.getCheckpointFileName()
+	if err := os.WriteFile(fileName+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+func (image ContainerImage) removeCheckpoint() {
+	os.RemoveAll(image.getExtractTempDestination())
+	os.Remove(image.getCheckpointFileName())
+}
+
+// restoreCheckpoint returns the checkpoint of the extraction of the given
+// layers. If the checkpoint belongs to another digest or does not exist, the
+// extraction starts from scratch.
+func (image ContainerImage) restoreCheckpoint(layers []manifest.LayerInfo) (*extractionCheckpoint, error) {
+	checkpoint, err := image.readCheckpoint()
+	if err == nil && checkpoint.Digest == image.Digest && len(checkpoint.Layers) <= len(layers) {
+		matches := true
+		for i, applied := range checkpoint.Layers {
+			matches = matches && applied == layers[i].Digest.String()
+		}
+		if matches {
+			return checkpoint, nil
+		}
+	}
+
+	image.removeCheckpoint()
+	checkpoint = &extractionCheckpoint{Digest: image.Digest}
+	if err := os.MkdirAll(image.getExtractTempDestination(), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return checkpoint, image.writeCheckpoint(checkpoint)
+}
+
+// removeIncompleteBlobs removes the blobs an interrupted skopeo copy left
+// behind. Complete blobs are only renamed into the layout once verified.
+func removeIncompleteBlobs(copyDir string) {
+	entries, err := os.ReadDir(copyDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "oci-put-blob") {
+			os.Remove(path.Join(copyDir, entry.Name()))
+		}
+	}
+}
+
+func getLayoutBlobPath(layoutDir string, blob digest.Digest) string {
+	return path.Join(layoutDir, "blobs", blob.Algorithm().String(), blob.Encoded())
+}
+
+// readCopiedManifest reads the manifest of the image from the OCI layout, it
+// is tagged by the digest of the image.
+func (image ContainerImage) readCopiedManifest(copyDir string) (manifest.Manifest, error) {
+	content, err := os.ReadFile(path.Join(copyDir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, err
+	}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[imgspecv1.AnnotationRefName] != image.Digest {
+			continue
+		}
+		raw, err := os.ReadFile(getLayoutBlobPath(copyDir, descriptor.Digest))
+		if err != nil {
+			return nil, err
+		}
+		return manifest.FromBlob(raw, manifest.GuessMIMEType(raw))
+	}
+	return nil, fmt.Errorf("no manifest of %s in %s", image.getFullDigest(), copyDir)
+}
+
+// verifyCopiedManifest ensures that the copied manifest has the config and the
+// layers of the expected manifest of the digest. The manifest itself is
+// converted to OCI by the copy.
+func (image ContainerImage) verifyCopiedManifest(copied manifest.Manifest, expected manifest.Manifest) error {
+	if copied.ConfigInfo().Digest != expected.ConfigInfo().Digest {
+		return fmt.Errorf("copied config %s does not match %s of %s", copied.ConfigInfo().Digest, expected.ConfigInfo().Digest, image.getFullDigest())
+	}
+	copiedLayers, expectedLayers := copied.LayerInfos(), expected.LayerInfos()
+	if len(copiedLayers) != len(expectedLayers) {
+		return fmt.Errorf("copied manifest has %d layers instead of %d of %s", len(copiedLayers), len(expectedLayers), image.getFullDigest())
+	}
+	for i := range copiedLayers {
+		if copiedLayers[i].Digest != expectedLayers[i].Digest {
+			return fmt.Errorf("copied layer %s does not match %s of %s", copiedLayers[i].Digest, expectedLayers[i].Digest, image.getFullDigest())
+		}
+	}
+	return nil
+}
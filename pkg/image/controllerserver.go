@@ -17,7 +17,12 @@ limitations under the License.
 package image
 
 import (
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -25,14 +30,184 @@ import (
 
 const (
 	deviceID = "deviceID"
+
+	// Volume attributes
+	imageAttribute        = "image"
+	pinnedDigestAttribute = "pinnedDigest"
+	stageModeAttribute    = "stageMode"
+	// Overrides the default tag update policy of the driver
+	tagUpdatePolicyAttribute = "tagUpdatePolicy"
+	// Overrides the default pull policy of the driver
+	pullPolicyAttribute = "pullPolicy"
+	// The digest the image is expected to resolve to
+	digestAttribute = "digest"
+
+	// Stage modes
+	stageModeBind = "bind"
+	stageModeCopy = "copy"
+
+	preparePollInterval = 5 * time.Second
+	// Minimum delay between two setups of an image waited for, the lock
+	// might be gone before the extraction shows up
+	prepareMinPollInterval = time.Second
 )
 
 func (ie *ImageExtractor) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, finalErr error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if err := validateId("volume id", req.GetName()); err != nil {
+		return nil, err
+	}
+	caps := req.GetVolumeCapabilities()
+	if caps == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
+	}
+	for _, cap := range caps {
+		if cap.GetBlock() != nil {
+			return nil, status.Error(codes.InvalidArgument, "Block access type not supported")
+		}
+	}
+
+	var containerImage *ContainerImage
+	if snapshotId := req.GetVolumeContentSource().GetSnapshot().GetSnapshotId(); len(snapshotId) > 0 {
+		// Restoring from a snapshot gives the digest recorded in the snapshot,
+		// even if the tag has moved since.
+		if err := validateId("snapshot id", snapshotId); err != nil {
+			return nil, err
+		}
+		snapshot, err := readSnapshot(snapshotId)
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotId)
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		containerImage, err = newPinnedContainerImage(snapshot.Image, snapshot.Digest)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Only snapshots are supported as volume content source")
+	}
+
+	image := req.GetParameters()[imageAttribute]
+	if containerImage != nil {
+		image = containerImage.Name
+	}
+	if len(image) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Image parameter missing in request")
+	}
+	image, err := normalizeImageName(image)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid image %s: %s", req.GetParameters()[imageAttribute], err.Error())
+	}
+
+	volumeId := req.GetName()
+	if pin, err := readVolumePin(volumeId); err == nil {
+		// CreateVolume is retried by the provisioner, the volume exists already
+		containerImage, err = newPinnedContainerImage(pin.Image, pin.Digest)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if containerImage.Name != image {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with image %s", volumeId, pin.Image)
+		}
+	} else if os.IsNotExist(err) {
+		if containerImage == nil {
+			containerImage, err = ie.newContainerImage(ctx, image)
+			if err != nil {
+				return nil, err
+			}
+			if err := verifyExpectedDigest(containerImage, req.GetParameters()[digestAttribute]); err != nil {
+				return nil, err
+			}
+		}
+		if err := pinVolume(volumeId, containerImage); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("volume %s pinned to %s@%s\n", volumeId, containerImage.Name, containerImage.getFullDigest())
+	} else {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// A node-local store of the controller is of no use to the nodes
+	if ie.config.StoreMode == storeModeShared {
+		if err := ie.prepareImage(ctx, containerImage); err != nil {
+			return nil, err
+		}
+	}
+	return ie.createVolumeResponse(volumeId, req, containerImage), nil
+}
+
+// prepareImage pulls and extracts the image into the store, so that the node
+// only needs to bind mount it. It waits until the image is ready or the
+// request is cancelled, in which case the provisioner retries later on.
+func (ie *ImageExtractor) prepareImage(ctx context.Context, image *ContainerImage) error {
+	for {
+		err := ie.setupImage(ctx, image, ie.controllerWorkers)
+		if err == nil {
+			return nil
+		}
+		if isPermanentPullError(err) || status.Code(err) == codes.ResourceExhausted {
+			// The store lacking room is not waited for
+			return err
+		}
+		glog.V(5).Infof("waiting for image %s: %s\n", image.Name, err.Error())
+
+		started := time.Now()
+		if !ie.waitForPullJob(ctx, image) {
+			ie.pullLocker.wait(ctx, image)
+		}
+		if remaining := prepareMinPollInterval - time.Since(started); remaining > 0 {
+			timer := time.NewTimer(remaining)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			return status.Errorf(status.FromContextError(ctx.Err()).Code(), "image %s not ready yet: %s", image.Name, err.Error())
+		}
+	}
+}
+
+func (ie *ImageExtractor) createVolumeResponse(volumeId string, req *csi.CreateVolumeRequest, image *ContainerImage) *csi.CreateVolumeResponse {
+	// Related options are handed over to the node as they are
+	volumeContext := map[string]string{}
+	for key, value := range req.GetParameters() {
+		volumeContext[key] = value
+	}
+	volumeContext[imageAttribute] = image.Name
+	volumeContext[pinnedDigestAttribute] = image.getFullDigest()
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeId,
+			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+			VolumeContext: volumeContext,
+			ContentSource: req.GetVolumeContentSource(),
+		},
+	}
 }
 
 func (ie *ImageExtractor) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if err := validateId("volume id", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+
+	volumeId := req.GetVolumeId()
+	if err := unpinVolume(volumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.V(4).Infof("volume %s unpinned\n", volumeId)
+
+	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (ie *ImageExtractor) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -66,15 +241,100 @@ func (ie *ImageExtractor) ControllerGetVolume(ctx context.Context, req *csi.Cont
 }
 
 func (ie *ImageExtractor) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
+	}
+	if err := validateId("snapshot id", req.GetName()); err != nil {
+		return nil, err
+	}
+	if err := validateId("volume id", req.GetSourceVolumeId()); err != nil {
+		return nil, err
+	}
+
+	snapshotId := req.GetName()
+	if snapshot, err := readSnapshot(snapshotId); err == nil {
+		// CreateSnapshot is retried by the snapshotter, the snapshot exists already
+		if snapshot.SourceVolumeId != req.GetSourceVolumeId() {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", snapshotId, snapshot.SourceVolumeId)
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: snapshot.toCSISnapshot()}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	pin, err := readVolumePin(req.GetSourceVolumeId())
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetSourceVolumeId())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	snapshot, err := createSnapshot(snapshotId, req.GetSourceVolumeId(), pin)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.V(4).Infof("snapshot %s of volume %s pinned to %s@%s\n", snapshotId, snapshot.SourceVolumeId, snapshot.Image, snapshot.Digest)
+
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot.toCSISnapshot()}, nil
 }
 
 func (ie *ImageExtractor) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	// Check arguments
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+	if err := validateId("snapshot id", req.GetSnapshotId()); err != nil {
+		return nil, err
+	}
+
+	snapshotId := req.GetSnapshotId()
+	if err := deleteSnapshot(snapshotId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.V(4).Infof("snapshot %s deleted\n", snapshotId)
+
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (ie *ImageExtractor) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range snapshots {
+		if len(req.GetSnapshotId()) > 0 && snapshot.Id != req.GetSnapshotId() {
+			continue
+		}
+		if len(req.GetSourceVolumeId()) > 0 && snapshot.SourceVolumeId != req.GetSourceVolumeId() {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot.toCSISnapshot()})
+	}
+
+	start := 0
+	if len(req.GetStartingToken()) > 0 {
+		start, err = strconv.Atoi(req.GetStartingToken())
+		if err != nil || start < 0 || start > len(entries) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %s", req.GetStartingToken())
+		}
+	}
+	end := len(entries)
+	nextToken := ""
+	if max := int(req.GetMaxEntries()); max > 0 && start+max < end {
+		end = start + max
+		nextToken = strconv.Itoa(end)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
 }
 
 func (ie *ImageExtractor) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
@@ -83,7 +343,9 @@ func (ie *ImageExtractor) ControllerExpandVolume(ctx context.Context, req *csi.C
 
 func (ie *ImageExtractor) getControllerServiceCapabilities() []*csi.ControllerServiceCapability {
 	var cl []csi.ControllerServiceCapability_RPC_Type
-	cl = append(cl, csi.ControllerServiceCapability_RPC_UNKNOWN)
+	cl = append(cl, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
+	cl = append(cl, csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT)
+	cl = append(cl, csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS)
 
 	var csc []*csi.ControllerServiceCapability
 
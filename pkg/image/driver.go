@@ -15,26 +15,112 @@ limitations under the License.
 package image
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 )
 
+// Time the driver waits for its pulls to abort and its calls to finish on
+// shutdown
+const shutdownTimeout = 10 * time.Second
+
 type ImageExtractor struct {
 	config Config
+	// Canceled when the driver shuts down, aborting its pulls
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Limits the number of extractions started by CreateVolume
+	controllerWorkers chan struct{}
+	// Limits the number of extractions started by the prefetcher
+	prefetchWorkers chan struct{}
+
+	// Coordinates the pulls of the drivers sharing the store
+	pullLocker pullLocker
+
+	// Schedules the extractions of this driver
+	pullQueue *pullQueue
+
+	// Space in the store reserved by the pulls of this driver. Reservations
+	// are per process, drivers sharing the store do not see each other's.
+	reservedSpace spaceReservation
+	// Pulls recently denied admission by digest
+	admissionFailures map[string]admissionFailure
+	spaceMutex        sync.Mutex
+
+	// Moving average of the durations of the pulls of this driver
+	averagePullDuration time.Duration
+	pullStatsMutex      sync.Mutex
+
+	// Resolutions by image name and extractions by digest in flight
+	resolutions map[string]*resolution
+	pullJobs    map[string]*pullJob
+	jobsMutex   sync.Mutex
+
+	// Copies to the local cache in progress
+	localCopies      map[string]bool
+	localCopiesMutex sync.Mutex
 }
 
+const (
+	// The store is a volume shared by all nodes
+	storeModeShared = "shared"
+	// The store is node-local and used by this node only
+	storeModeLocal = "local"
+)
+
 type Config struct {
 	DriverName         string
 	Endpoint           string
 	NodeID             string
 	VendorVersion      string
 	ImageStoreDir      string
+	StoreMode          string
+	StoreCapacity      int64
+	ExpansionRatio     float64
+	LocalCacheDir      string
+	LocalCacheCapacity int64
 	MaxPublishDuration time.Duration
+	LockBackend        string
+	LockNamespace      string
+	LockTTL            time.Duration
+	TagUpdatePolicy    string
+	PullPolicy         string
+	ResolveCacheTTL    time.Duration
+	ResolveTimeout     time.Duration
+	DownloadTimeout    time.Duration
+	ExtractTimeout     time.Duration
+	ControllerWorkers  int
+	MaxPulls           int
+	MaxRegistryPulls   int
+	PullRetries        int
+	PullBackoff        time.Duration
+	NegativeCacheTTL   time.Duration
+	GCRetention        time.Duration
+	GCInterval         time.Duration
+	WarmImages         []string
+	WarmImagesFile     string
+	WarmInterval       time.Duration
+
+	// Accept images referenced by digest without resolving them
+	TrustDigestReferences bool
+
+	PrefetchInterval    time.Duration
+	PrefetchWindow      time.Duration
+	PrefetchMinRequests int
+	PrefetchConcurrency int
+	// Bytes the prefetcher may pull per prefetch interval
+	PrefetchBudget int64
+
+	// Address of the admin interface serving metrics and pulls in progress
+	AdminAddress string
 }
 
 var (
@@ -43,6 +129,16 @@ var (
 	copyDir     string
 	extractDir  string
 	digestDir   string
+	pinDir      string
+	snapshotDir string
+	sizeDir     string
+	historyDir  string
+	publishDir  string
+	resolveDir  string
+	tempDir     string
+	blobDir     string
+	blobRefDir  string
+	failureDir  string
 )
 
 func NewImageExtractor(cfg Config) (*ImageExtractor, error) {
@@ -62,10 +158,89 @@ func NewImageExtractor(cfg Config) (*ImageExtractor, error) {
 		return nil, errors.New("no image store dir provided")
 	}
 
+	if cfg.StoreMode != storeModeShared && cfg.StoreMode != storeModeLocal {
+		return nil, fmt.Errorf("unsupported store mode %s", cfg.StoreMode)
+	}
+
+	if cfg.ExpansionRatio < 1 {
+		return nil, errors.New("expansion ratio must be at least 1")
+	}
+
+	if cfg.LocalCacheDir != "" {
+		if cfg.LocalCacheCapacity == 0 {
+			return nil, errors.New("no local cache capacity provided")
+		}
+		if err := initLocalCache(cfg.LocalCacheDir); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.MaxPublishDuration == 0 {
 		return nil, errors.New("no max publish duration provided")
 	}
 
+	if cfg.LockBackend != lockBackendFile && cfg.LockBackend != lockBackendLease {
+		return nil, fmt.Errorf("unsupported lock backend %s", cfg.LockBackend)
+	}
+
+	if cfg.LockBackend == lockBackendLease {
+		if cfg.StoreMode != storeModeShared {
+			return nil, errors.New("lease lock backend requires a shared store")
+		}
+		if cfg.LockNamespace == "" {
+			return nil, errors.New("no lock namespace provided")
+		}
+	}
+
+	if cfg.LockTTL == 0 {
+		return nil, errors.New("no lock ttl provided")
+	}
+	if cfg.LockTTL < time.Second {
+		// Leases are renewed every third of the ttl and last whole seconds
+		return nil, fmt.Errorf("lock ttl %s is shorter than one second", cfg.LockTTL)
+	}
+
+	if cfg.TagUpdatePolicy != tagUpdatePolicyWait && cfg.TagUpdatePolicy != tagUpdatePolicyServePrevious {
+		return nil, fmt.Errorf("unsupported tag update policy %s", cfg.TagUpdatePolicy)
+	}
+
+	if cfg.PullPolicy != pullPolicyAlways && cfg.PullPolicy != pullPolicyIfNotPresent && cfg.PullPolicy != pullPolicyNever {
+		return nil, fmt.Errorf("unsupported pull policy %s", cfg.PullPolicy)
+	}
+
+	if cfg.ResolveTimeout == 0 {
+		return nil, errors.New("no resolve timeout provided")
+	}
+
+	if cfg.ControllerWorkers < 1 {
+		return nil, errors.New("at least one controller worker required")
+	}
+
+	if cfg.MaxPulls < 1 || cfg.MaxRegistryPulls < 1 {
+		return nil, errors.New("at least one concurrent pull required")
+	}
+
+	if cfg.PullRetries > 0 && cfg.PullBackoff == 0 {
+		return nil, errors.New("no pull backoff provided")
+	}
+
+	if (cfg.GCRetention > 0 || cfg.StoreCapacity > 0) && cfg.GCInterval == 0 {
+		return nil, errors.New("no garbage collection interval provided")
+	}
+
+	if (len(cfg.WarmImages) > 0 || cfg.WarmImagesFile != "") && cfg.WarmInterval == 0 {
+		return nil, errors.New("no warm interval provided")
+	}
+
+	if cfg.PrefetchInterval > 0 {
+		if cfg.PrefetchWindow == 0 {
+			return nil, errors.New("no prefetch window provided")
+		}
+		if cfg.PrefetchConcurrency < 1 {
+			return nil, errors.New("at least one prefetch worker required")
+		}
+	}
+
 	if _, err := os.Stat(cfg.ImageStoreDir); os.IsNotExist(err) {
 		return nil, fmt.Errorf("image store %s does not exist", cfg.ImageStoreDir)
 	} else {
@@ -75,38 +250,172 @@ func NewImageExtractor(cfg Config) (*ImageExtractor, error) {
 		copyDir = path.Join(cfg.ImageStoreDir, "copy")
 		extractDir = path.Join(cfg.ImageStoreDir, "extract")
 		digestDir = path.Join(cfg.ImageStoreDir, "digest")
+		pinDir = path.Join(cfg.ImageStoreDir, "pin")
+		snapshotDir = path.Join(cfg.ImageStoreDir, "snapshot")
+		sizeDir = path.Join(cfg.ImageStoreDir, "size")
+		historyDir = path.Join(cfg.ImageStoreDir, "history")
+		publishDir = path.Join(cfg.ImageStoreDir, "publish")
+		resolveDir = path.Join(cfg.ImageStoreDir, "resolve")
+		tempDir = path.Join(cfg.ImageStoreDir, "tmp")
+		blobDir = path.Join(cfg.ImageStoreDir, "blobs")
+		blobRefDir = path.Join(cfg.ImageStoreDir, "blobref")
+		failureDir = path.Join(cfg.ImageStoreDir, "failed")
 
-		dirs := [5]string{
+		dirs := [15]string{
 			progressDir,
 			requestDir,
 			copyDir,
 			extractDir,
 			digestDir,
+			pinDir,
+			snapshotDir,
+			sizeDir,
+			historyDir,
+			publishDir,
+			resolveDir,
+			tempDir,
+			blobDir,
+			blobRefDir,
+			failureDir,
 		}
 		for _, dir := range dirs {
 			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 				return nil, fmt.Errorf("creating dir %s failed %s", dir, err.Error())
 			}
 		}
+
+		if err := migrateStore(cfg.ImageStoreDir, cfg.MaxPublishDuration, cfg.PrefetchWindow); err != nil {
+			return nil, fmt.Errorf("migrating store %s failed %s", cfg.ImageStoreDir, err.Error())
+		}
 	}
 
 	glog.Infof("Driver: %v ", cfg.DriverName)
 	glog.Infof("Version: %s", cfg.VendorVersion)
 	glog.Infof("ImageStoreDir: %s ", cfg.ImageStoreDir)
+	glog.Infof("StoreMode: %s", cfg.StoreMode)
+	glog.Infof("StoreCapacity: %d", cfg.StoreCapacity)
+	glog.Infof("ExpansionRatio: %g", cfg.ExpansionRatio)
+	glog.Infof("LocalCacheDir: %s", cfg.LocalCacheDir)
+	glog.Infof("LocalCacheCapacity: %d", cfg.LocalCacheCapacity)
 	glog.Infof("MaxPublishDuration: %s", cfg.MaxPublishDuration)
+	glog.Infof("LockBackend: %s", cfg.LockBackend)
+	glog.Infof("LockNamespace: %s", cfg.LockNamespace)
+	glog.Infof("LockTTL: %s", cfg.LockTTL)
+	glog.Infof("TagUpdatePolicy: %s", cfg.TagUpdatePolicy)
+	glog.Infof("PullPolicy: %s", cfg.PullPolicy)
+	glog.Infof("ResolveCacheTTL: %s", cfg.ResolveCacheTTL)
+	glog.Infof("ResolveTimeout: %s", cfg.ResolveTimeout)
+	glog.Infof("DownloadTimeout: %s", cfg.DownloadTimeout)
+	glog.Infof("ExtractTimeout: %s", cfg.ExtractTimeout)
+	glog.Infof("TrustDigestReferences: %t", cfg.TrustDigestReferences)
+	glog.Infof("ControllerWorkers: %d", cfg.ControllerWorkers)
+	glog.Infof("MaxPulls: %d", cfg.MaxPulls)
+	glog.Infof("MaxRegistryPulls: %d", cfg.MaxRegistryPulls)
+	glog.Infof("PullRetries: %d", cfg.PullRetries)
+	glog.Infof("PullBackoff: %s", cfg.PullBackoff)
+	glog.Infof("NegativeCacheTTL: %s", cfg.NegativeCacheTTL)
+	glog.Infof("GCRetention: %s", cfg.GCRetention)
+	glog.Infof("WarmImages: %v", cfg.WarmImages)
+	glog.Infof("WarmImagesFile: %s", cfg.WarmImagesFile)
+	glog.Infof("PrefetchInterval: %s", cfg.PrefetchInterval)
+	glog.Infof("AdminAddress: %s", cfg.AdminAddress)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	ie := &ImageExtractor{
-		config: cfg,
+		config:            cfg,
+		ctx:               ctx,
+		cancel:            cancel,
+		controllerWorkers: make(chan struct{}, cfg.ControllerWorkers),
+		prefetchWorkers:   make(chan struct{}, cfg.PrefetchConcurrency),
+		pullQueue:         newPullQueue(cfg.MaxPulls, cfg.MaxRegistryPulls),
+		resolutions:       map[string]*resolution{},
+		pullJobs:          map[string]*pullJob{},
+		localCopies:       map[string]bool{},
+		admissionFailures: map[string]admissionFailure{},
+	}
+
+	if cfg.LockBackend == lockBackendLease {
+		locker, err := newInClusterLeasePullLocker(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating lease lock backend failed %s", err.Error())
+		}
+		ie.pullLocker = locker
+	} else {
+		ie.pullLocker = newFilePullLocker(cfg)
+	}
+
+	if err := ie.recoverPulls(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("recovering pulls failed %s", err.Error())
 	}
 
 	return ie, nil
 }
 
 func (ie *ImageExtractor) Run() error {
+	if ie.config.GCRetention > 0 || ie.config.StoreCapacity > 0 {
+		go ie.runGarbageCollection()
+	}
+
+	if len(ie.config.WarmImages) > 0 || ie.config.WarmImagesFile != "" {
+		go ie.runWarmer()
+	}
+
+	if ie.config.PrefetchInterval > 0 {
+		go ie.runPrefetcher()
+	}
+
+	if ie.config.AdminAddress != "" {
+		go ie.runAdminServer()
+	}
+
 	s := NewNonBlockingGRPCServer()
 	// ImageExtractor itself implements ControllerServer, NodeServer, and IdentityServer.
 	s.Start(ie.config.Endpoint, ie, ie, ie)
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		glog.Infof("Received %s, shutting down", sig)
+		ie.shutdown()
+		ie.stopServer(s)
+		close(stopped)
+	}()
 	s.Wait()
+	// Serving ends as soon as the server is stopped, the running calls are
+	// still finishing then
+	if ie.ctx.Err() != nil {
+		<-stopped
+	}
 
 	return nil
 }
+
+// shutdown aborts the pulls of the driver and waits for them to release
+// their locks, so that other nodes can take them over right away. Queued
+// pulls hold no lock yet and are dropped from the queue. The pulls resume
+// from their checkpoints.
+func (ie *ImageExtractor) shutdown() {
+	ie.cancel()
+	deadline := time.Now().Add(shutdownTimeout)
+	for len(ie.getPullJobs()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stopServer lets the running calls finish, calls still waiting after the
+// shutdown timeout are aborted.
+func (ie *ImageExtractor) stopServer(s *nonBlockingGRPCServer) {
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		s.ForceStop()
+	}
+}
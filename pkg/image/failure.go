@@ -0,0 +1,320 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// Maximum delay between two attempts of a pull
+	maxPullBackoff = 5 * time.Minute
+	// Estimated duration of a pull, as long as no pull has completed
+	defaultPullDuration = time.Minute
+)
+
+// pullError is a classified error of a registry operation.
+type pullError struct {
+	code codes.Code
+	// Retrying does not help, e.g. the image does not exist
+	permanent bool
+	message   string
+}
+
+func (e *pullError) Error() string {
+	return e.message
+}
+
+// GRPCStatus lets status.FromError and status.Code pick up the code.
+func (e *pullError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.message)
+}
+
+// Patterns of skopeo errors, matched against the lower-cased output. Only
+// full phrases are matched, the output contains image names and digests,
+// which may contain status codes or words like "denied" by chance.
+var permanentPullErrors = []struct {
+	code     codes.Code
+	patterns []string
+}{
+	{codes.NotFound, []string{
+		"manifest unknown",
+		"name unknown",
+		"blob unknown",
+		"status code 404",
+		"status 404",
+		"404 not found",
+		"404 (not found)",
+	}},
+	{codes.PermissionDenied, []string{
+		"unauthorized: ",
+		"authentication required",
+		"requested access to the resource is denied",
+		"status code 401",
+		"status 401",
+		"401 unauthorized",
+		"401 (unauthorized)",
+		"status code 403",
+		"status 403",
+		"403 forbidden",
+		"403 (forbidden)",
+	}},
+	{codes.ResourceExhausted, []string{
+		"exceeds the size limit",
+		"request entity too large",
+		"no space left on device",
+	}},
+}
+
+// classifyPullError classifies the error of skopeo by its output. Errors not
+// known as permanent, e.g. network errors, 5xx or 429 responses of the
+// registry, are considered transient.
+func classifyPullError(err error, output []byte) error {
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if len(output) == 0 && errors.As(err, &exitErr) {
+		output = exitErr.Stderr
+	}
+	message := strings.TrimSpace(string(output))
+	if message == "" {
+		message = err.Error()
+	}
+
+	lowered := strings.ToLower(message)
+	for _, class := range permanentPullErrors {
+		for _, pattern := range class.patterns {
+			if strings.Contains(lowered, pattern) {
+				return &pullError{code: class.code, permanent: true, message: message}
+			}
+		}
+	}
+	return &pullError{code: codes.Unavailable, message: message}
+}
+
+func isPermanentPullError(err error) bool {
+	var pullErr *pullError
+	return errors.As(err, &pullErr) && pullErr.permanent
+}
+
+// retryPull runs the operation of the pull of the image until it succeeds,
+// fails permanently, the retries are exhausted or the context is done. Every
+// attempt is bounded by the timeout, if given, attempts timing out are
+// retried. The delay between the attempts doubles, starting at the
+// configured pull backoff.
+func (ie *ImageExtractor) retryPull(ctx context.Context, image *ContainerImage, operation string, timeout time.Duration, run func(context.Context) error) error {
+	backoff := ie.config.PullBackoff
+	for attempt := 0; ; attempt++ {
+		err := runWithTimeout(ctx, operation, timeout, run)
+		if err != nil && ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if err == nil || isPermanentPullError(err) || attempt >= ie.config.PullRetries {
+			return err
+		}
+		glog.V(4).Infof("%s of %s failed, retrying in %s: %s\n", operation, image.Name, backoff, err.Error())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxPullBackoff {
+			backoff = maxPullBackoff
+		}
+	}
+}
+
+// runWithTimeout runs the operation, failing with a transient
+// DeadlineExceeded once the timeout has passed.
+func runWithTimeout(ctx context.Context, operation string, timeout time.Duration, run func(context.Context) error) error {
+	if timeout == 0 {
+		return run(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := run(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &pullError{code: codes.DeadlineExceeded, message: fmt.Sprintf("%s timed out after %s", operation, timeout)}
+	}
+	return err
+}
+
+// pullFailure records a permanent failure of the pull of a digest or of the
+// resolution of an image name. It is returned to publishers until it expires
+// after the negative cache TTL.
+type pullFailure struct {
+	Image   string     `json:"image"`
+	Digest  string     `json:"digest"`
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message"`
+	Time    time.Time  `json:"time"`
+}
+
+func (image ContainerImage) getFailureFileName() string {
+	return path.Join(failureDir, image.Digest)
+}
+
+// getResolutionFailureFileName returns the failure of the resolution of the
+// image name. Keys of normalized image names contain an escaped '/' and never
+// collide with digests.
+func (image ContainerImage) getResolutionFailureFileName() string {
+	return path.Join(failureDir, image.getFileName())
+}
+
+// failPull records permanent failures of the pull of the image.
+func (ie *ImageExtractor) failPull(image *ContainerImage, err error) {
+	ie.recordFailure(image, image.getFailureFileName(), err)
+}
+
+// failResolution records permanent failures of the resolution of the image
+// name, e.g. an unknown tag, which has no digest to record the failure by.
+func (ie *ImageExtractor) failResolution(image *ContainerImage, err error) {
+	ie.recordFailure(image, image.getResolutionFailureFileName(), err)
+}
+
+func (ie *ImageExtractor) recordFailure(image *ContainerImage, fileName string, err error) {
+	var pullErr *pullError
+	if !errors.As(err, &pullErr) || !pullErr.permanent || ie.config.NegativeCacheTTL == 0 {
+		return
+	}
+	failure := pullFailure{
+		Image:   image.Name,
+		Digest:  image.Digest,
+		Code:    pullErr.code,
+		Message: pullErr.message,
+		Time:    time.Now(),
+	}
+	content, err := json.Marshal(failure)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(fileName, content, 0644); err != nil {
+		glog.V(4).Infof("recording failure of %s failed %s\n", image.Name, err.Error())
+	}
+}
+
+// getPullFailure returns the recorded failure of the pull of the image as
+// status error, as long as it has not expired.
+func (ie *ImageExtractor) getPullFailure(image *ContainerImage) error {
+	return ie.readFailure(image, image.getFailureFileName(), "pull")
+}
+
+// getResolutionFailure returns the recorded failure of the resolution of the
+// image name as status error, as long as it has not expired.
+func (ie *ImageExtractor) getResolutionFailure(image *ContainerImage) error {
+	return ie.readFailure(image, image.getResolutionFailureFileName(), "resolution")
+}
+
+func (ie *ImageExtractor) readFailure(image *ContainerImage, fileName string, operation string) error {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil
+	}
+	var failure pullFailure
+	if err := json.Unmarshal(content, &failure); err != nil || time.Since(failure.Time) > ie.config.NegativeCacheTTL {
+		os.Remove(fileName)
+		return nil
+	}
+	return &pullError{
+		code:      failure.Code,
+		permanent: true,
+		message:   fmt.Sprintf("%s of %s failed at %s: %s", operation, image.Name, failure.Time.Format(time.RFC3339), failure.Message),
+	}
+}
+
+// recordPullDuration updates the moving average of the durations of the pulls
+// of this driver.
+func (ie *ImageExtractor) recordPullDuration(duration time.Duration) {
+	ie.pullStatsMutex.Lock()
+	defer ie.pullStatsMutex.Unlock()
+	if ie.averagePullDuration == 0 {
+		ie.averagePullDuration = duration
+	} else {
+		ie.averagePullDuration = (4*ie.averagePullDuration + duration) / 5
+	}
+}
+
+// estimatePullDuration estimates the time until the pull of the image started
+// at since is done. Queued pulls wait for the pulls ahead, which run in
+// batches of the maximum concurrent pulls. Running pulls are estimated from
+// their progress, if known.
+func (ie *ImageExtractor) estimatePullDuration(ctx context.Context, image *ContainerImage, since time.Time) time.Duration {
+	if position, _ := ie.pullQueue.position(image.Digest); position == 0 {
+		if progress := ie.getPullProgress(ctx, image); progress != nil && !progress.ETA.IsZero() {
+			remaining := time.Until(progress.ETA)
+			if remaining < preparePollInterval {
+				remaining = preparePollInterval
+			}
+			return remaining
+		}
+	}
+
+	ie.pullStatsMutex.Lock()
+	average := ie.averagePullDuration
+	ie.pullStatsMutex.Unlock()
+	if average == 0 {
+		average = defaultPullDuration
+	}
+
+	remaining := average
+	if position, _ := ie.pullQueue.position(image.Digest); position > 0 {
+		remaining = average * time.Duration((position-1)/ie.config.MaxPulls+1)
+	} else if !since.IsZero() {
+		remaining -= time.Since(since)
+	}
+	if remaining < preparePollInterval {
+		remaining = preparePollInterval
+	}
+	return remaining
+}
+
+// pullInProgressError returns Unavailable with a RetryInfo detail estimating
+// when the pull of the image will be done.
+func (ie *ImageExtractor) pullInProgressError(ctx context.Context, image *ContainerImage, since time.Time, msg string) error {
+	st := status.New(codes.Unavailable, msg)
+	retryInfo := &errdetails.RetryInfo{
+		RetryDelay: durationpb.New(ie.estimatePullDuration(ctx, image, since)),
+	}
+	if detailed, err := st.WithDetails(retryInfo); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// storeError classifies an error of the store, a full store is permanent.
+func storeError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return &pullError{code: codes.ResourceExhausted, permanent: true, message: err.Error()}
+	}
+	return &pullError{code: codes.Internal, message: err.Error()}
+}
@@ -0,0 +1,139 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyPullError(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		code      codes.Code
+		permanent bool
+	}{
+		{
+			name:      "manifest unknown",
+			output:    "Error: reading manifest latest in docker.io/library/nope: manifest unknown: manifest unknown",
+			code:      codes.NotFound,
+			permanent: true,
+		},
+		{
+			name:      "name unknown",
+			output:    "Error: initializing source docker://registry.example.com/nope:latest: reading manifest latest in registry.example.com/nope: name unknown: repository name not known to registry",
+			code:      codes.NotFound,
+			permanent: true,
+		},
+		{
+			name:      "status 404",
+			output:    "Error: reading blob sha256:1234: fetching blob: invalid status code from registry 404 (Not Found)",
+			code:      codes.NotFound,
+			permanent: true,
+		},
+		{
+			name:      "unauthorized",
+			output:    "Error: initializing source docker://registry.example.com/private:latest: reading manifest latest in registry.example.com/private: unauthorized: authentication required",
+			code:      codes.PermissionDenied,
+			permanent: true,
+		},
+		{
+			name:      "access denied",
+			output:    "Error: initializing source docker://private:latest: reading manifest latest in docker.io/library/private: requested access to the resource is denied",
+			code:      codes.PermissionDenied,
+			permanent: true,
+		},
+		{
+			name:      "status 403",
+			output:    "Error: reading manifest latest in registry.example.com/private: invalid status code from registry 403 (Forbidden)",
+			code:      codes.PermissionDenied,
+			permanent: true,
+		},
+		{
+			name:      "no space left",
+			output:    "Error: writing blob: write /store/copy/oci-put-blob123: no space left on device",
+			code:      codes.ResourceExhausted,
+			permanent: true,
+		},
+		{
+			name:   "digest containing a status code",
+			output: "Error: reading blob sha256:3e4f40494049abcdef0401403a: read tcp 10.0.0.1:4049->10.0.0.2:443: i/o timeout",
+			code:   codes.Unavailable,
+		},
+		{
+			name:   "image name containing not found and denied",
+			output: "Error: initializing source docker://registry.example.com/denied/not-found:404: pinging container registry registry.example.com: Get \"https://registry.example.com/v2/\": dial tcp: lookup registry.example.com: no such host",
+			code:   codes.Unavailable,
+		},
+		{
+			name:   "server error",
+			output: "Error: reading manifest latest in registry.example.com/app: received unexpected HTTP status: 503 Service Unavailable",
+			code:   codes.Unavailable,
+		},
+		{
+			name:   "too many requests",
+			output: "Error: reading manifest latest in docker.io/library/busybox: toomanyrequests: You have reached your pull rate limit",
+			code:   codes.Unavailable,
+		},
+	}
+	for _, test := range tests {
+		err := classifyPullError(errors.New("exit status 1"), []byte(test.output))
+		if code := status.Code(err); code != test.code {
+			t.Errorf("%s: classified as %s, want %s", test.name, code, test.code)
+		}
+		if permanent := isPermanentPullError(err); permanent != test.permanent {
+			t.Errorf("%s: classified as permanent %t, want %t", test.name, permanent, test.permanent)
+		}
+	}
+
+	if err := classifyPullError(nil, nil); err != nil {
+		t.Errorf("success classified as %v", err)
+	}
+	if err := classifyPullError(errors.New("exit status 1"), nil); err == nil || err.Error() != "exit status 1" {
+		t.Errorf("error without output classified as %v", err)
+	}
+}
+
+func TestResolutionFailure(t *testing.T) {
+	failureDir = t.TempDir()
+	ie := &ImageExtractor{config: Config{NegativeCacheTTL: time.Minute}}
+	image := &ContainerImage{Name: "docker.io/library/busybox:unknown"}
+
+	// Transient failures are resolved again
+	ie.failResolution(image, &pullError{code: codes.Unavailable, message: "connection refused"})
+	if err := ie.getResolutionFailure(image); err != nil {
+		t.Errorf("transient failure recorded as %v", err)
+	}
+
+	ie.failResolution(image, &pullError{code: codes.NotFound, permanent: true, message: "manifest unknown"})
+	if _, err := ie.newContainerImage(context.Background(), "busybox:unknown"); status.Code(err) != codes.NotFound {
+		t.Errorf("resolving unknown tag returned %v, want the recorded failure", err)
+	}
+	digestImage := &ContainerImage{Name: image.Name, Digest: "790b52558236313f0939403be37e5e5e7c767602975ba3f740ad887a3e28f1ed"}
+	if err := ie.getPullFailure(digestImage); err != nil {
+		t.Errorf("failure of the resolution returned for digest as %v", err)
+	}
+
+	ie.config.NegativeCacheTTL = time.Nanosecond
+	if err := ie.getResolutionFailure(image); err != nil {
+		t.Errorf("expired failure returned as %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// extractionInfo describes an extracted image in the store.
+type extractionInfo struct {
+	Digest   string
+	LastUsed time.Time
+	Size     int64
+	Pinned   bool
+}
+
+func (ie *ImageExtractor) runGarbageCollection() {
+	for {
+		if err := ie.collectGarbage(); err != nil {
+			glog.Errorf("garbage collection failed %s", err.Error())
+		}
+		time.Sleep(ie.config.GCInterval)
+	}
+}
+
+// collectGarbage removes extractions, which have not been used within the
+// retention period. If the store exceeds its capacity, the least recently
+// used extractions are removed as well. Extractions pinned by volumes,
+// snapshots or running pods are kept. Blobs no extraction refers to anymore
+// are removed from the blob store.
+func (ie *ImageExtractor) collectGarbage() error {
+	removeStalePublishPins(ie.config.NodeID)
+	// Blobs of the extractions removed are released
+	defer ie.removeUnreferencedBlobs()
+
+	extractions, err := ie.listExtractions()
+	if err != nil {
+		return err
+	}
+
+	var usage int64
+	var candidates []extractionInfo
+	for _, extraction := range extractions {
+		if ie.config.GCRetention > 0 && !extraction.Pinned && time.Since(extraction.LastUsed) > ie.config.GCRetention {
+			glog.V(4).Infof("removing extraction %s unused since %s\n", extraction.Digest, extraction.LastUsed.Format(time.RFC3339Nano))
+			removeExtraction(extraction.Digest)
+			continue
+		}
+		usage += extraction.Size
+		if !extraction.Pinned {
+			candidates = append(candidates, extraction)
+		}
+	}
+	glog.V(5).Infof("store usage %d bytes of %d bytes\n", usage, ie.config.StoreCapacity)
+
+	if ie.config.StoreCapacity == 0 || usage <= ie.config.StoreCapacity {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+	})
+	for _, extraction := range candidates {
+		if usage <= ie.config.StoreCapacity {
+			break
+		}
+		glog.V(4).Infof("removing extraction %s of %d bytes exceeding store capacity\n", extraction.Digest, extraction.Size)
+		removeExtraction(extraction.Digest)
+		usage -= extraction.Size
+	}
+	if usage > ie.config.StoreCapacity {
+		glog.Warningf("store usage %d bytes exceeds capacity %d bytes, remaining extractions are pinned", usage, ie.config.StoreCapacity)
+	}
+	return nil
+}
+
+// evictExtractions removes the least recently used extractions, which are not
+// pinned, until the given number of bytes has been freed.
+func (ie *ImageExtractor) evictExtractions(bytes int64) error {
+	// Blobs of the extractions removed are released
+	defer ie.removeUnreferencedBlobs()
+
+	extractions, err := ie.listExtractions()
+	if err != nil {
+		return err
+	}
+	sort.Slice(extractions, func(i, j int) bool {
+		return extractions[i].LastUsed.Before(extractions[j].LastUsed)
+	})
+	var freed int64
+	for _, extraction := range extractions {
+		if freed >= bytes {
+			break
+		}
+		if extraction.Pinned {
+			continue
+		}
+		glog.V(4).Infof("evicting extraction %s of %d bytes\n", extraction.Digest, extraction.Size)
+		removeExtraction(extraction.Digest)
+		freed += extraction.Size
+	}
+	return nil
+}
+
+// listExtractions returns the completed extractions in the store, see
+// hasCompleteExtraction.
+func (ie *ImageExtractor) listExtractions() ([]extractionInfo, error) {
+	pinned, err := getPinnedDigests()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(extractDir)
+	if err != nil {
+		return nil, err
+	}
+	var extractions []extractionInfo
+	for _, entry := range entries {
+		digest := entry.Name()
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size, err := readExtractionSize(digest)
+		if os.IsNotExist(err) && time.Since(info.ModTime()) > ie.config.MaxPublishDuration {
+			// Extracted before sizes were recorded
+			if err = writeExtractionSize(digest); err == nil {
+				size, err = readExtractionSize(digest)
+			}
+		}
+		if err != nil {
+			continue
+		}
+		extractions = append(extractions, extractionInfo{
+			Digest: digest,
+			// The modification time is updated whenever the extraction is used
+			LastUsed: info.ModTime(),
+			Size:     size,
+			Pinned:   pinned[fmt.Sprintf("sha256:%s", digest)],
+		})
+	}
+	return extractions, nil
+}
+
+func removeExtraction(digest string) {
+	removeDigestLinks(digest)
+	removeBlobReferences(digest)
+	if err := os.RemoveAll(path.Join(extractDir, digest)); err != nil {
+		glog.V(4).Infof("removing extraction %s failed %s\n", digest, err.Error())
+		return
+	}
+	os.Remove(path.Join(sizeDir, digest))
+}
+
+// removeDigestLinks removes the links of the image names to the digest.
+func removeDigestLinks(digest string) {
+	filepath.Walk(digestDir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode()&os.ModeSymlink != 0 && info.Name() == digest {
+			os.Remove(name)
+		}
+		return nil
+	})
+}
+
+func writeExtractionSize(digest string) error {
+	size, err := getDirSize(path.Join(extractDir, digest))
+	if err != nil {
+		return err
+	}
+	return writeSize(path.Join(sizeDir, digest), size)
+}
+
+func readExtractionSize(digest string) (int64, error) {
+	return readSize(path.Join(sizeDir, digest))
+}
+
+// getDirSize returns the bytes of the regular files in the dir.
+func getDirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func writeSize(fileName string, size int64) error {
+	return os.WriteFile(fileName, []byte(strconv.FormatInt(size, 10)), 0644)
+}
+
+func readSize(fileName string) (int64, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
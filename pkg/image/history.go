@@ -0,0 +1,165 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Tag update policies, deciding what new pods get while the new digest of a
+// moved tag is pulled. Running pods always keep their digest.
+const (
+	// New pods wait for the new digest
+	tagUpdatePolicyWait = "Wait"
+	// New pods get the previous digest until the new one is extracted
+	tagUpdatePolicyServePrevious = "ServePrevious"
+)
+
+// digestHistoryEntry records when a tag was resolved to a digest.
+type digestHistoryEntry struct {
+	Time   time.Time
+	Digest string
+}
+
+func (image ContainerImage) getHistoryFileName() string {
+	return path.Join(historyDir, image.getFileName())
+}
+
+// recordDigestHistory appends the digest to the history of the tag, if it
+// differs from the last one recorded.
+func (image ContainerImage) recordDigestHistory() error {
+	history, err := image.readDigestHistory()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(history) > 0 && history[len(history)-1].Digest == image.getFullDigest() {
+		return nil
+	}
+
+	file, err := os.OpenFile(image.getHistoryFileName(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s\n", time.Now().Format(time.RFC3339Nano), image.getFullDigest())
+	return err
+}
+
+// readDigestHistory returns the digests the tag was resolved to, the oldest
+// first.
+func (image ContainerImage) readDigestHistory() ([]digestHistoryEntry, error) {
+	file, err := os.Open(image.getHistoryFileName())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var history []digestHistoryEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		resolved, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			continue
+		}
+		history = append(history, digestHistoryEntry{Time: resolved, Digest: fields[1]})
+	}
+	return history, scanner.Err()
+}
+
+// getPreviousImage returns the most recent digest of the tag before the
+// current one, which is fully extracted.
+func (image ContainerImage) getPreviousImage() *ContainerImage {
+	history, err := image.readDigestHistory()
+	if err != nil {
+		return nil
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Digest == image.getFullDigest() {
+			continue
+		}
+		previous, err := newPinnedContainerImage(image.Name, history[i].Digest)
+		if err != nil {
+			continue
+		}
+		if previous.hasCompleteExtraction() {
+			return previous
+		}
+	}
+	return nil
+}
+
+// getServablePreviousImage returns the previous image of the tag, which may
+// be served while the image is not ready yet, nil if there is none. Volumes
+// stating the digest they expect never get another one, they fail with
+// FailedPrecondition instead.
+func (image ContainerImage) getServablePreviousImage(expectedDigest string) (*ContainerImage, error) {
+	previous := image.getPreviousImage()
+	if previous == nil {
+		return nil, nil
+	}
+	if err := verifyExpectedDigest(previous, expectedDigest); err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// setupTaggedVolume sets up the volume like setupVolume. If the image is not
+// ready yet and the tag update policy allows, the previous digest of the tag
+// is returned instead. Otherwise an extraction of the image by this driver is
+// waited for.
+func (ie *ImageExtractor) setupTaggedVolume(ctx context.Context, volumeId string, image *ContainerImage, volumeContext map[string]string) (*ContainerImage, error) {
+	err := ie.setupVolume(ctx, volumeId, image)
+	if err == nil {
+		return image, nil
+	}
+	if _, ok := volumeContext[pinnedDigestAttribute]; ok {
+		if err := ie.waitForImage(ctx, image, err); err != nil {
+			return nil, err
+		}
+		return image, nil
+	}
+
+	policy := volumeContext[tagUpdatePolicyAttribute]
+	if policy == "" {
+		policy = ie.config.TagUpdatePolicy
+	}
+	if policy != tagUpdatePolicyServePrevious {
+		if err := ie.waitForImage(ctx, image, err); err != nil {
+			return nil, err
+		}
+		return image, nil
+	}
+	previous, verifyErr := image.getServablePreviousImage(volumeContext[digestAttribute])
+	if verifyErr != nil {
+		return nil, verifyErr
+	} else if previous == nil {
+		return nil, err
+	}
+	glog.V(4).Infof("serving previous digest %s of %s: %s\n", previous.getFullDigest(), image.Name, err.Error())
+	previous.recordImageUse()
+	return previous, nil
+}
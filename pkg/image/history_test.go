@@ -0,0 +1,61 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"path"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServePreviousWithExpectedDigest(t *testing.T) {
+	historyDir = t.TempDir()
+	sizeDir = t.TempDir()
+
+	const name = "docker.io/library/busybox:latest"
+	old := &ContainerImage{Name: name, Digest: "1111111111111111111111111111111111111111111111111111111111111111"}
+	current := &ContainerImage{Name: name, Digest: "2222222222222222222222222222222222222222222222222222222222222222"}
+	for _, image := range []*ContainerImage{old, current} {
+		if err := image.recordDigestHistory(); err != nil {
+			t.Fatalf("recording history failed %s", err.Error())
+		}
+	}
+	// Only the old digest is extracted
+	if err := writeSize(path.Join(sizeDir, old.Digest), 1); err != nil {
+		t.Fatalf("recording size failed %s", err.Error())
+	}
+
+	previous, err := current.getServablePreviousImage("")
+	if err != nil || previous == nil || previous.Digest != old.Digest {
+		t.Errorf("previous image without expected digest is %v %v, want %s", previous, err, old.Digest)
+	}
+
+	previous, err = current.getServablePreviousImage(current.getFullDigest())
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("previous image %v served for tag with expected digest, got error %v, want FailedPrecondition", previous, err)
+	}
+	if previous != nil {
+		t.Errorf("previous image %s served for tag with expected digest", previous.Digest)
+	}
+
+	// The current digest is not extracted, there is nothing to serve and the
+	// caller keeps its error
+	previous, err = old.getServablePreviousImage(old.getFullDigest())
+	if previous != nil || err != nil {
+		t.Errorf("previous image of the oldest digest is %v %v, want none", previous, err)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resolution is a resolution of an image name against the registry in
+// flight. Concurrent callers share it.
+type resolution struct {
+	done  chan struct{}
+	image *ContainerImage
+	err   error
+}
+
+// pullJob is an extraction of a digest by this driver in flight. Concurrent
+// publishers share it and are notified once done is closed.
+type pullJob struct {
+	image   *ContainerImage
+	tracker *pullTracker
+	done    chan struct{}
+}
+
+// newContainerImage resolves the image like NewContainerImage, concurrent
+// resolutions of the same image share one registry roundtrip. The roundtrip
+// is bounded by the resolve timeout and outlives callers giving up, so that
+// the remaining callers are not aborted. Permanent failures, e.g. an unknown
+// tag, are recorded by the image name and returned without resolving again
+// until they expire.
+func (ie *ImageExtractor) newContainerImage(ctx context.Context, name string) (*ContainerImage, error) {
+	name, err := normalizeImageName(name)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid image %s", err.Error())
+	}
+	if err := ie.getResolutionFailure(&ContainerImage{Name: name}); err != nil {
+		return nil, err
+	}
+
+	ie.jobsMutex.Lock()
+	r, ok := ie.resolutions[name]
+	if !ok {
+		r = &resolution{done: make(chan struct{})}
+		ie.resolutions[name] = r
+	}
+	ie.jobsMutex.Unlock()
+
+	if !ok {
+		go func() {
+			resolveCtx, cancel := context.WithTimeout(ie.ctx, ie.config.ResolveTimeout)
+			defer cancel()
+			r.image, r.err = NewContainerImage(resolveCtx, name)
+			if r.err != nil {
+				ie.failResolution(&ContainerImage{Name: name}, r.err)
+			}
+			ie.jobsMutex.Lock()
+			delete(ie.resolutions, name)
+			ie.jobsMutex.Unlock()
+			close(r.done)
+		}()
+	}
+	select {
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	case <-r.done:
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	// Callers must not share the image
+	image := *r.image
+	return &image, nil
+}
+
+// startPullJob registers the extraction of the image. It returns nil, if the
+// digest is already being extracted by this driver.
+func (ie *ImageExtractor) startPullJob(image *ContainerImage) *pullJob {
+	ie.jobsMutex.Lock()
+	defer ie.jobsMutex.Unlock()
+	if _, ok := ie.pullJobs[image.Digest]; ok {
+		return nil
+	}
+	job := &pullJob{
+		image:   image,
+		tracker: newPullTracker(),
+		done:    make(chan struct{}),
+	}
+	ie.pullJobs[image.Digest] = job
+	return job
+}
+
+// finishPullJob notifies the publishers waiting for the extraction.
+func (ie *ImageExtractor) finishPullJob(image *ContainerImage, job *pullJob) {
+	ie.jobsMutex.Lock()
+	defer ie.jobsMutex.Unlock()
+	delete(ie.pullJobs, image.Digest)
+	close(job.done)
+}
+
+// getPullJobs returns the extractions of this driver in flight.
+func (ie *ImageExtractor) getPullJobs() []*pullJob {
+	ie.jobsMutex.Lock()
+	defer ie.jobsMutex.Unlock()
+	jobs := make([]*pullJob, 0, len(ie.pullJobs))
+	for _, job := range ie.pullJobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func (ie *ImageExtractor) getPullJob(image *ContainerImage) *pullJob {
+	ie.jobsMutex.Lock()
+	defer ie.jobsMutex.Unlock()
+	return ie.pullJobs[image.Digest]
+}
+
+// waitForPullJob waits for the extraction of the image by this driver. It
+// returns false right away, if there is none.
+func (ie *ImageExtractor) waitForPullJob(ctx context.Context, image *ContainerImage) bool {
+	job := ie.getPullJob(image)
+	if job == nil {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+	case <-job.done:
+	}
+	return true
+}
+
+// waitForImage waits as long as the image is extracted by this driver and
+// sets it up again afterwards. Otherwise it returns the given error of the
+// previous setup.
+func (ie *ImageExtractor) waitForImage(ctx context.Context, image *ContainerImage, err error) error {
+	for err != nil && ctx.Err() == nil && ie.waitForPullJob(ctx, image) {
+		if ctx.Err() != nil {
+			break
+		}
+		err = ie.setupImage(ctx, image, nil)
+	}
+	return err
+}
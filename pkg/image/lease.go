@@ -0,0 +1,446 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	leaseNamePrefix = "image-extractor-"
+	// Annotations recording the pulled image, so that an interrupted pull can
+	// be resumed
+	leaseImageAnnotation  = "image-extractor/image"
+	leaseDigestAnnotation = "image-extractor/digest"
+	// Annotation recording the progress of the pull as of the last renewal
+	leaseProgressAnnotation = "image-extractor/progress"
+	// Timeout of a single request to the API server
+	leaseRequestTimeout = 10 * time.Second
+)
+
+// leasePullLocker locks pulls by coordination.k8s.io Leases, one per digest
+// like the pull lock files.
+// The holder identity is unique per acquisition and serves as fencing token.
+// Leases are deleted on unlock.
+type leasePullLocker struct {
+	client    kubernetes.Interface
+	namespace string
+	nodeID    string
+	ttl       time.Duration
+
+	// Holder identities and progress of the leases held by this driver
+	pulls      map[string]string
+	progress   map[string]*pullProgress
+	pullsMutex sync.Mutex
+}
+
+func newLeasePullLocker(client kubernetes.Interface, namespace string, nodeID string, ttl time.Duration) *leasePullLocker {
+	return &leasePullLocker{
+		client:    client,
+		namespace: namespace,
+		nodeID:    nodeID,
+		ttl:       ttl,
+		pulls:     map[string]string{},
+		progress:  map[string]*pullProgress{},
+	}
+}
+
+// newInClusterLeasePullLocker uses the service account of the driver pod.
+func newInClusterLeasePullLocker(cfg Config) (*leasePullLocker, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newLeasePullLocker(client, cfg.LockNamespace, cfg.NodeID, cfg.LockTTL), nil
+}
+
+func getLeaseName(image *ContainerImage) string {
+	return leaseNamePrefix + image.getPullKey()
+}
+
+func getLeaseHolder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func isLeaseExpired(lease *coordinationv1.Lease) bool {
+	if getLeaseHolder(lease) == "" || lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return time.Since(lease.Spec.RenewTime.Time) > duration
+}
+
+func (l *leasePullLocker) lock(image *ContainerImage, lost func()) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	name := getLeaseName(image)
+
+	holder := fmt.Sprintf("%s_%d", l.nodeID, time.Now().UnixNano())
+	now := metav1.NewMicroTime(time.Now())
+	// Rounded up, so that the lease never expires before the lock ttl
+	seconds := int32(math.Ceil(l.ttl.Seconds()))
+
+	// Conflicting creates and updates ensure that image is only processed once
+	tookOver := false
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					leaseImageAnnotation:  image.Name,
+					leaseDigestAnnotation: image.Digest,
+				},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if _, err := leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	} else {
+		if !isLeaseExpired(lease) {
+			return false, fmt.Errorf("image is being pulled by %s", getLeaseHolder(lease))
+		}
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		lease.Annotations[leaseImageAnnotation] = image.Name
+		lease.Annotations[leaseDigestAnnotation] = image.Digest
+		delete(lease.Annotations, leaseProgressAnnotation)
+		lease.Spec.HolderIdentity = &holder
+		lease.Spec.LeaseDurationSeconds = &seconds
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+		if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			return false, err
+		}
+		tookOver = true
+	}
+
+	l.pullsMutex.Lock()
+	l.pulls[name] = holder
+	l.pullsMutex.Unlock()
+
+	go l.renew(name, holder, lost)
+	return tookOver, nil
+}
+
+// renew renews the lease until the pull is unlocked or the lease is lost.
+func (l *leasePullLocker) renew(name string, holder string, lost func()) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.pullsMutex.Lock()
+		current, ok := l.pulls[name]
+		progress := l.progress[name]
+		l.pullsMutex.Unlock()
+		if !ok || current != holder {
+			return
+		}
+
+		if err := l.renewOnce(name, holder, progress); err != nil {
+			glog.Warningf("renewing lease %s failed %s\n", name, err.Error())
+			if err == errPullLockLost {
+				lost()
+				return
+			}
+		}
+	}
+}
+
+// renewOnce renews the lease and records the progress of the pull in it. It
+// fails with errPullLockLost, if the lease is not held by the holder anymore.
+func (l *leasePullLocker) renewOnce(name string, holder string, progress *pullProgress) error {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	lease, err := l.getOwnLease(ctx, name, holder)
+	if err != nil {
+		return err
+	}
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+	if progress != nil {
+		if content, err := json.Marshal(progress); err == nil {
+			if lease.Annotations == nil {
+				lease.Annotations = map[string]string{}
+			}
+			lease.Annotations[leaseProgressAnnotation] = string(content)
+		}
+	}
+	_, err = l.client.CoordinationV1().Leases(l.namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// getOwnLease fails with errPullLockLost, unless the lease is held by the
+// given holder.
+func (l *leasePullLocker) getOwnLease(ctx context.Context, name string, holder string) (*coordinationv1.Lease, error) {
+	lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, errPullLockLost
+	} else if err != nil {
+		return nil, err
+	}
+	if getLeaseHolder(lease) != holder {
+		return nil, errPullLockLost
+	}
+	return lease, nil
+}
+
+func (l *leasePullLocker) getHeldLease(ctx context.Context, image *ContainerImage) (*coordinationv1.Lease, error) {
+	name := getLeaseName(image)
+	l.pullsMutex.Lock()
+	holder, ok := l.pulls[name]
+	l.pullsMutex.Unlock()
+	if !ok {
+		return nil, errPullLockLost
+	}
+	return l.getOwnLease(ctx, name, holder)
+}
+
+func (l *leasePullLocker) verify(image *ContainerImage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	_, err := l.getHeldLease(ctx, image)
+	return err
+}
+
+func (l *leasePullLocker) unlock(image *ContainerImage) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	name := getLeaseName(image)
+	if lease, err := l.getHeldLease(ctx, image); err == nil {
+		// Preconditions prevent deleting a lease taken over in the meantime
+		err := l.client.CoordinationV1().Leases(l.namespace).Delete(ctx, name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{
+				UID:             &lease.UID,
+				ResourceVersion: &lease.ResourceVersion,
+			},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			glog.Warningf("deleting lease %s failed %s\n", name, err.Error())
+		}
+	}
+
+	l.pullsMutex.Lock()
+	defer l.pullsMutex.Unlock()
+	delete(l.pulls, name)
+	delete(l.progress, name)
+}
+
+func (l *leasePullLocker) inProgress(ctx context.Context, image *ContainerImage) (bool, time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, leaseRequestTimeout)
+	defer cancel()
+	lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(ctx, getLeaseName(image), metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			glog.Warningf("getting lease of %s failed %s\n", image.Name, err.Error())
+		}
+		return false, time.Time{}
+	}
+	var since time.Time
+	if lease.Spec.AcquireTime != nil {
+		since = lease.Spec.AcquireTime.Time
+	}
+	return true, since
+}
+
+func (l *leasePullLocker) isStale(ctx context.Context, image *ContainerImage) bool {
+	ctx, cancel := context.WithTimeout(ctx, leaseRequestTimeout)
+	defer cancel()
+	lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(ctx, getLeaseName(image), metav1.GetOptions{})
+	if err != nil {
+		return apierrors.IsNotFound(err)
+	}
+	return isLeaseExpired(lease)
+}
+
+// wait watches the lease until it is deleted or changes its holder. As an
+// owner, which has gone, does not touch the lease anymore, waiting ends after
+// the lease duration as well.
+func (l *leasePullLocker) wait(ctx context.Context, image *ContainerImage) {
+	ctx, cancel := context.WithTimeout(ctx, l.ttl)
+	defer cancel()
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	name := getLeaseName(image)
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			glog.Warningf("getting lease %s failed %s\n", name, err.Error())
+			<-ctx.Done()
+		}
+		return
+	}
+	watcher, err := leases.Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+		ResourceVersion: lease.ResourceVersion,
+	})
+	if err != nil {
+		glog.Warningf("watching lease %s failed %s\n", name, err.Error())
+		<-ctx.Done()
+		return
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case watch.Deleted, watch.Error:
+				return
+			case watch.Modified:
+				if modified, ok := event.Object.(*coordinationv1.Lease); ok && getLeaseHolder(modified) != getLeaseHolder(lease) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// recover deletes the leases held by this node before a restart, holder
+// identities are prefixed by the node.
+func (l *leasePullLocker) recover() ([]*ContainerImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	list, err := leases.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var images []*ContainerImage
+	for i := range list.Items {
+		lease := &list.Items[i]
+		if !strings.HasPrefix(lease.Name, leaseNamePrefix) || !strings.HasPrefix(getLeaseHolder(lease), l.nodeID+"_") {
+			continue
+		}
+		glog.V(4).Infof("deleting lease %s of interrupted pull\n", lease.Name)
+		err := leases.Delete(ctx, lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{
+				UID:             &lease.UID,
+				ResourceVersion: &lease.ResourceVersion,
+			},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			glog.Warningf("deleting lease %s failed %s\n", lease.Name, err.Error())
+			continue
+		}
+		if name, digest := lease.Annotations[leaseImageAnnotation], lease.Annotations[leaseDigestAnnotation]; name != "" && digest != "" {
+			images = append(images, &ContainerImage{Name: name, Digest: digest})
+		}
+	}
+	return images, nil
+}
+
+func (l *leasePullLocker) setProgress(image *ContainerImage, progress *pullProgress) {
+	name := getLeaseName(image)
+	l.pullsMutex.Lock()
+	defer l.pullsMutex.Unlock()
+	if _, ok := l.pulls[name]; ok {
+		l.progress[name] = progress
+	}
+}
+
+func getLeaseProgress(lease *coordinationv1.Lease) *pullProgress {
+	content, ok := lease.Annotations[leaseProgressAnnotation]
+	if !ok {
+		return nil
+	}
+	var progress pullProgress
+	if err := json.Unmarshal([]byte(content), &progress); err != nil {
+		return nil
+	}
+	return &progress
+}
+
+func (l *leasePullLocker) getProgress(ctx context.Context, image *ContainerImage) (*pullProgress, error) {
+	ctx, cancel := context.WithTimeout(ctx, leaseRequestTimeout)
+	defer cancel()
+	lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(ctx, getLeaseName(image), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return getLeaseProgress(lease), nil
+}
+
+func (l *leasePullLocker) list(ctx context.Context) ([]pullStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, leaseRequestTimeout)
+	defer cancel()
+	list, err := l.client.CoordinationV1().Leases(l.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var pulls []pullStatus
+	for i := range list.Items {
+		lease := &list.Items[i]
+		if !strings.HasPrefix(lease.Name, leaseNamePrefix) {
+			continue
+		}
+		pull := pullStatus{
+			Image:    lease.Annotations[leaseImageAnnotation],
+			Digest:   lease.Annotations[leaseDigestAnnotation],
+			Stale:    isLeaseExpired(lease),
+			Progress: getLeaseProgress(lease),
+		}
+		// Holder identities are the node followed by the acquisition time
+		if holder := getLeaseHolder(lease); strings.Contains(holder, "_") {
+			pull.Owner = holder[:strings.LastIndex(holder, "_")]
+		}
+		if lease.Spec.AcquireTime != nil {
+			pull.Acquired = lease.Spec.AcquireTime.Time
+		}
+		pulls = append(pulls, pull)
+	}
+	return pulls, nil
+}
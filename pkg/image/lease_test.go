@@ -0,0 +1,187 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testLeaseNamespace = "image-extractor"
+
+var testLeaseImage = &ContainerImage{
+	Name:   "docker.io/library/busybox:latest",
+	Digest: "790b52558236313f0939403be37e5e5e7c767602975ba3f740ad887a3e28f1ed",
+}
+
+func getTestLease(t *testing.T, client *fake.Clientset) *coordinationv1.Lease {
+	t.Helper()
+	lease, err := client.CoordinationV1().Leases(testLeaseNamespace).Get(context.Background(), getLeaseName(testLeaseImage), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting lease failed %s", err.Error())
+	}
+	return lease
+}
+
+func TestLeaseAcquire(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	first := newLeasePullLocker(client, testLeaseNamespace, "node-a", 1500*time.Millisecond)
+	second := newLeasePullLocker(client, testLeaseNamespace, "node-b", 1500*time.Millisecond)
+
+	tookOver, err := first.lock(testLeaseImage, func() {})
+	if err != nil {
+		t.Fatalf("locking failed %s", err.Error())
+	}
+	if tookOver {
+		t.Errorf("lock of a new lease reported a takeover")
+	}
+	lease := getTestLease(t, client)
+	if *lease.Spec.LeaseDurationSeconds != 2 {
+		t.Errorf("lease duration is %d seconds, want the ttl rounded up to 2", *lease.Spec.LeaseDurationSeconds)
+	}
+	if lease.Annotations[leaseImageAnnotation] != testLeaseImage.Name || lease.Annotations[leaseDigestAnnotation] != testLeaseImage.Digest {
+		t.Errorf("lease does not record the image, annotations %v", lease.Annotations)
+	}
+	if inProgress, _ := second.inProgress(context.Background(), testLeaseImage); !inProgress {
+		t.Errorf("pull is not in progress for other nodes")
+	}
+	if second.isStale(context.Background(), testLeaseImage) {
+		t.Errorf("held lease is stale")
+	}
+
+	if _, err := second.lock(testLeaseImage, func() {}); err == nil {
+		t.Errorf("lease held by another node has been acquired")
+	}
+	if err := first.verify(testLeaseImage); err != nil {
+		t.Errorf("verifying held lease failed %s", err.Error())
+	}
+}
+
+func TestLeaseRenew(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := newLeasePullLocker(client, testLeaseNamespace, "node-a", time.Minute)
+	if _, err := locker.lock(testLeaseImage, func() {}); err != nil {
+		t.Fatalf("locking failed %s", err.Error())
+	}
+	acquired := getTestLease(t, client).Spec.RenewTime.Time
+
+	time.Sleep(time.Millisecond)
+	name := getLeaseName(testLeaseImage)
+	holder := locker.pulls[name]
+	progress := &pullProgress{Phase: pullPhaseDownloading}
+	if err := locker.renewOnce(name, holder, progress); err != nil {
+		t.Fatalf("renewing failed %s", err.Error())
+	}
+	lease := getTestLease(t, client)
+	if !lease.Spec.RenewTime.Time.After(acquired) {
+		t.Errorf("renew time %s not after %s", lease.Spec.RenewTime.Time, acquired)
+	}
+	recorded, err := locker.getProgress(context.Background(), testLeaseImage)
+	if err != nil || recorded == nil || recorded.Phase != pullPhaseDownloading {
+		t.Errorf("progress not recorded in lease, got %v %v", recorded, err)
+	}
+
+	if err := locker.renewOnce(name, "node-b_1", nil); err != errPullLockLost {
+		t.Errorf("renewing lease of another holder returned %v, want %v", err, errPullLockLost)
+	}
+}
+
+func TestLeaseStaleTakeover(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	first := newLeasePullLocker(client, testLeaseNamespace, "node-a", time.Minute)
+	second := newLeasePullLocker(client, testLeaseNamespace, "node-b", time.Minute)
+	if _, err := first.lock(testLeaseImage, func() {}); err != nil {
+		t.Fatalf("locking failed %s", err.Error())
+	}
+	name := getLeaseName(testLeaseImage)
+	holder := first.pulls[name]
+
+	// The first node stops renewing the lease
+	lease := getTestLease(t, client)
+	renewed := metav1.NewMicroTime(time.Now().Add(-2 * time.Minute))
+	lease.Spec.RenewTime = &renewed
+	if _, err := client.CoordinationV1().Leases(testLeaseNamespace).Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating lease failed %s", err.Error())
+	}
+	if !second.isStale(context.Background(), testLeaseImage) {
+		t.Fatalf("expired lease is not stale")
+	}
+
+	tookOver, err := second.lock(testLeaseImage, func() {})
+	if err != nil {
+		t.Fatalf("taking over failed %s", err.Error())
+	}
+	if !tookOver {
+		t.Errorf("takeover of an expired lease not reported")
+	}
+	lease = getTestLease(t, client)
+	if *lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("lease transitions are %d, want 1", *lease.Spec.LeaseTransitions)
+	}
+
+	if err := first.verify(testLeaseImage); err != errPullLockLost {
+		t.Errorf("verifying lease taken over returned %v, want %v", err, errPullLockLost)
+	}
+	if err := first.renewOnce(name, holder, nil); err != errPullLockLost {
+		t.Errorf("renewing lease taken over returned %v, want %v", err, errPullLockLost)
+	}
+	// The previous owner must not release the lease of the new one
+	first.unlock(testLeaseImage)
+	if err := second.verify(testLeaseImage); err != nil {
+		t.Errorf("lease lost after unlock by previous owner %s", err.Error())
+	}
+}
+
+func TestLeaseRelease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := newLeasePullLocker(client, testLeaseNamespace, "node-a", time.Minute)
+	if _, err := locker.lock(testLeaseImage, func() {}); err != nil {
+		t.Fatalf("locking failed %s", err.Error())
+	}
+	locker.unlock(testLeaseImage)
+
+	if inProgress, _ := locker.inProgress(context.Background(), testLeaseImage); inProgress {
+		t.Errorf("pull still in progress after unlock")
+	}
+	if err := locker.verify(testLeaseImage); err != errPullLockLost {
+		t.Errorf("verifying released lease returned %v, want %v", err, errPullLockLost)
+	}
+	if tookOver, err := newLeasePullLocker(client, testLeaseNamespace, "node-b", time.Minute).lock(testLeaseImage, func() {}); err != nil || tookOver {
+		t.Errorf("locking released lease returned %t %v", tookOver, err)
+	}
+}
+
+func TestLeaseName(t *testing.T) {
+	// Leases are keyed by digest like the lock files, copies and checkpoints
+	sameDigest := &ContainerImage{Name: "docker.io/library/busybox:stable", Digest: testLeaseImage.Digest}
+	if getLeaseName(testLeaseImage) != getLeaseName(sameDigest) {
+		t.Errorf("image names sharing a digest got distinct leases %s and %s", getLeaseName(testLeaseImage), getLeaseName(sameDigest))
+	}
+	newDigest := &ContainerImage{Name: testLeaseImage.Name, Digest: "1111111111111111111111111111111111111111111111111111111111111111"}
+	if getLeaseName(testLeaseImage) == getLeaseName(newDigest) {
+		t.Errorf("digests of a tag share the lease %s", getLeaseName(newDigest))
+	}
+	for _, image := range []*ContainerImage{testLeaseImage, newDigest} {
+		if errs := validation.IsDNS1123Subdomain(getLeaseName(image)); len(errs) > 0 {
+			t.Errorf("lease name %s is invalid: %v", getLeaseName(image), errs)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/mount-utils"
+)
+
+// The local cache keeps copies of extracted images on node-local disk in
+// front of the shared store. The shared store stays the source of truth.
+// The size of every copy is recorded next to it, as measured on local disk.
+
+const localSizeSuffix = ".size"
+
+func (image ContainerImage) getLocalCacheDestination(localCacheDir string) string {
+	return path.Join(localCacheDir, image.Digest)
+}
+
+// getLocalCopySize returns the size of the local copy, which is measured
+// once, if it has not been recorded yet.
+func getLocalCopySize(copyPath string) (int64, error) {
+	if size, err := readSize(copyPath + localSizeSuffix); err == nil {
+		return size, nil
+	}
+	size, err := getDirSize(copyPath)
+	if err != nil {
+		return 0, err
+	}
+	return size, writeSize(copyPath+localSizeSuffix, size)
+}
+
+// initLocalCache removes copies interrupted by a restart of the driver and
+// sizes of copies, which do not exist anymore.
+func initLocalCache(localCacheDir string) error {
+	if err := os.MkdirAll(localCacheDir, os.ModePerm); err != nil {
+		return fmt.Errorf("creating dir %s failed %s", localCacheDir, err.Error())
+	}
+	entries, err := os.ReadDir(localCacheDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(localCacheDir, entry.Name())
+		if strings.HasSuffix(entry.Name(), partialSuffix) {
+			os.RemoveAll(name)
+		} else if strings.HasSuffix(entry.Name(), localSizeSuffix) {
+			if _, err := os.Stat(strings.TrimSuffix(name, localSizeSuffix)); os.IsNotExist(err) {
+				os.Remove(name)
+			}
+		}
+	}
+	return nil
+}
+
+// getVolumeSource returns the path the extracted image is mounted from. That
+// is the local copy if it exists, otherwise the shared store, while the local
+// copy is made in the background.
+func (ie *ImageExtractor) getVolumeSource(image *ContainerImage) string {
+	if ie.config.LocalCacheDir == "" {
+		return image.getExtractDestination()
+	}
+
+	localCopy := image.getLocalCacheDestination(ie.config.LocalCacheDir)
+	if _, err := os.Stat(localCopy); err == nil {
+		currentTime := time.Now().Local()
+		os.Chtimes(localCopy, currentTime, currentTime)
+		return localCopy
+	}
+
+	ie.localCopiesMutex.Lock()
+	defer ie.localCopiesMutex.Unlock()
+	if !ie.localCopies[image.Digest] {
+		ie.localCopies[image.Digest] = true
+		go ie.copyToLocalCache(image)
+	}
+	return image.getExtractDestination()
+}
+
+func (ie *ImageExtractor) copyToLocalCache(image *ContainerImage) {
+	defer func() {
+		ie.localCopiesMutex.Lock()
+		defer ie.localCopiesMutex.Unlock()
+		delete(ie.localCopies, image.Digest)
+	}()
+
+	if size, err := readExtractionSize(image.Digest); err == nil && size > ie.config.LocalCacheCapacity {
+		glog.V(4).Infof("%s with %d bytes exceeds local cache capacity\n", image.Name, size)
+		return
+	}
+
+	localCopy := image.getLocalCacheDestination(ie.config.LocalCacheDir)
+	partialCopy := localCopy + partialSuffix
+	glog.V(4).Infof("Copy %s to local cache %s\n", image.Name, localCopy)
+	os.RemoveAll(partialCopy)
+	cmd := exec.Command("cp", "-a", image.getExtractDestination(), partialCopy)
+	if stdoutStderr, err := cmd.CombinedOutput(); err != nil {
+		glog.V(4).Infof("copying %s to local cache failed %s: %s\n", image.Name, err.Error(), stdoutStderr)
+		os.RemoveAll(partialCopy)
+		return
+	}
+	if _, err := getLocalCopySize(partialCopy); err != nil {
+		glog.V(4).Infof("measuring local copy of %s failed %s\n", image.Name, err.Error())
+		os.RemoveAll(partialCopy)
+		return
+	}
+	if err := os.Rename(partialCopy+localSizeSuffix, localCopy+localSizeSuffix); err != nil {
+		glog.V(4).Infof("recording size of %s in local cache failed %s\n", image.Name, err.Error())
+		os.RemoveAll(partialCopy)
+		return
+	}
+	if err := os.Rename(partialCopy, localCopy); err != nil {
+		glog.V(4).Infof("moving %s into local cache failed %s\n", image.Name, err.Error())
+		os.RemoveAll(partialCopy)
+		return
+	}
+	glog.V(4).Infof("%s ready in local cache\n", image.Name)
+
+	ie.evictLocalCache()
+}
+
+// evictLocalCache removes the least recently used copies exceeding the local
+// cache capacity. Copies mounted by pods are kept.
+func (ie *ImageExtractor) evictLocalCache() {
+	entries, err := os.ReadDir(ie.config.LocalCacheDir)
+	if err != nil {
+		glog.V(4).Infof("reading local cache failed %s\n", err.Error())
+		return
+	}
+
+	var usage int64
+	var copies []extractionInfo
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), partialSuffix) || strings.HasSuffix(entry.Name(), localSizeSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size, err := getLocalCopySize(path.Join(ie.config.LocalCacheDir, entry.Name()))
+		if err != nil {
+			glog.V(4).Infof("measuring local copy %s failed %s\n", entry.Name(), err.Error())
+			continue
+		}
+		usage += size
+		copies = append(copies, extractionInfo{
+			Digest:   entry.Name(),
+			LastUsed: info.ModTime(),
+			Size:     size,
+		})
+	}
+
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].LastUsed.Before(copies[j].LastUsed)
+	})
+	mounter := mount.New("")
+	for _, localCopy := range copies {
+		if usage <= ie.config.LocalCacheCapacity {
+			return
+		}
+		copyPath := path.Join(ie.config.LocalCacheDir, localCopy.Digest)
+		if refs, err := mounter.GetMountRefs(copyPath); err != nil || len(refs) > 0 {
+			continue
+		}
+		glog.V(4).Infof("removing %s of %d bytes from local cache\n", localCopy.Digest, localCopy.Size)
+		if err := os.RemoveAll(copyPath); err != nil {
+			glog.V(4).Infof("removing %s from local cache failed %s\n", localCopy.Digest, err.Error())
+			continue
+		}
+		os.Remove(copyPath + localSizeSuffix)
+		usage -= localCopy.Size
+	}
+}
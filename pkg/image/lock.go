@@ -0,0 +1,500 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Pulls are locked by files in the store
+	lockBackendFile = "file"
+	// Pulls are locked by coordination.k8s.io Leases
+	lockBackendLease = "lease"
+)
+
+var errPullLockLost = errors.New("pull lock lost")
+
+// pullLocker coordinates the pulls of the drivers sharing the store, so that
+// every image is pulled only once.
+type pullLocker interface {
+	// lock takes the pull lock of the image. It returns whether an expired
+	// lock has been taken over, the leftovers of its owner have to be
+	// removed then. lost is called, if the lock is taken over by another
+	// node while it is held.
+	lock(image *ContainerImage, lost func()) (bool, error)
+	// verify fails with errPullLockLost, if the lock has been taken over in
+	// the meantime. It is checked before the extraction is committed.
+	verify(image *ContainerImage) error
+	unlock(image *ContainerImage)
+	// inProgress returns whether the pull of the image is locked and since
+	// when.
+	inProgress(ctx context.Context, image *ContainerImage) (bool, time.Time)
+	// isStale returns whether the owner of the lock has gone.
+	isStale(ctx context.Context, image *ContainerImage) bool
+	// wait returns once the lock of the image might have been released.
+	wait(ctx context.Context, image *ContainerImage)
+	// recover releases the locks held by this node before a restart and
+	// returns the images, whose pulls have been interrupted.
+	recover() ([]*ContainerImage, error)
+	// setProgress records the progress of a pull of this driver, it is
+	// published with the next heartbeat.
+	setProgress(image *ContainerImage, progress *pullProgress)
+	// getProgress returns the progress recorded by the owner of the lock.
+	getProgress(ctx context.Context, image *ContainerImage) (*pullProgress, error)
+	// list returns the pulls in progress of all drivers sharing the store.
+	list(ctx context.Context) ([]pullStatus, error)
+}
+
+// pullStatus describes a pull in progress.
+type pullStatus struct {
+	Image    string        `json:"image"`
+	Digest   string        `json:"digest"`
+	Owner    string        `json:"owner"`
+	Acquired time.Time     `json:"acquired"`
+	Stale    bool          `json:"stale"`
+	Progress *pullProgress `json:"progress,omitempty"`
+}
+
+// lockPull marks the pull of the image as in progress. An expired lock is
+// taken over, leftovers of its owner are removed. lost is called once the
+// lock is lost.
+func (ie *ImageExtractor) lockPull(ctx context.Context, image *ContainerImage, lost func()) error {
+	tookOver, err := ie.pullLocker.lock(image, lost)
+	if err != nil {
+		return err
+	}
+	if tookOver {
+		glog.V(4).Infof("took over pull of %s\n", image.Name)
+		if err := ie.waitForPreviousOwner(ctx, image); err != nil {
+			ie.unlockPull(image)
+			return err
+		}
+		image.cleanup()
+	}
+	return nil
+}
+
+// waitForPreviousOwner waits until the previous owner of a lock taken over
+// has stopped writing to the copy and the temp dir of the pull. On a shared
+// store the owner might still be alive, it finds out about the takeover with
+// its next heartbeat and aborts its pull. The lock is verified afterwards, as
+// the previous owner might have overwritten it in the meantime.
+func (ie *ImageExtractor) waitForPreviousOwner(ctx context.Context, image *ContainerImage) error {
+	if ie.config.StoreMode == storeModeLocal {
+		return nil
+	}
+	timer := time.NewTimer(ie.config.LockTTL)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	return ie.verifyPullLock(image)
+}
+
+func (ie *ImageExtractor) unlockPull(image *ContainerImage) {
+	ie.pullLocker.unlock(image)
+}
+
+// verifyPullLock checks the fencing token before the extraction is committed.
+func (ie *ImageExtractor) verifyPullLock(image *ContainerImage) error {
+	return ie.pullLocker.verify(image)
+}
+
+func (ie *ImageExtractor) isPullInProgress(ctx context.Context, image *ContainerImage) (bool, time.Time) {
+	return ie.pullLocker.inProgress(ctx, image)
+}
+
+func (ie *ImageExtractor) isPullStale(ctx context.Context, image *ContainerImage) bool {
+	return ie.pullLocker.isStale(ctx, image)
+}
+
+// filePullLock is the content of the lock file of a pull in progress.
+type filePullLock struct {
+	// Node pulling the image
+	Owner  string `json:"owner"`
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+	// Fencing token, increased on every takeover. The owner commits the
+	// extraction only as long as the lock file still carries its token.
+	Token     int64     `json:"token"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// Progress as of the last heartbeat
+	Progress *pullProgress `json:"progress,omitempty"`
+}
+
+// filePullLocker locks pulls by files in the inprogress directory of the
+// store. It is the default backend.
+type filePullLocker struct {
+	nodeID             string
+	storeMode          string
+	ttl                time.Duration
+	maxPublishDuration time.Duration
+
+	// Fencing tokens and progress of the locks held by this driver
+	pulls      map[string]int64
+	progress   map[string]*pullProgress
+	pullsMutex sync.Mutex
+}
+
+func newFilePullLocker(cfg Config) *filePullLocker {
+	return &filePullLocker{
+		nodeID:             cfg.NodeID,
+		storeMode:          cfg.StoreMode,
+		ttl:                cfg.LockTTL,
+		maxPublishDuration: cfg.MaxPublishDuration,
+		pulls:              map[string]int64{},
+		progress:           map[string]*pullProgress{},
+	}
+}
+
+// readPullLock reads the lock file. Lock files of older versions of the
+// driver are empty, their modification time is taken as heartbeat.
+func readPullLock(fileName string) (*filePullLock, error) {
+	file, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var lock filePullLock
+	if err := json.Unmarshal(content, &lock); err != nil || lock.Owner == "" {
+		return &filePullLock{Acquired: file.ModTime(), Heartbeat: file.ModTime()}, nil
+	}
+	return &lock, nil
+}
+
+func (l *filePullLocker) getTempFileName(fileName string, suffix string) string {
+	return fmt.Sprintf("%s+%s+%s", fileName, encodeStoreKey(l.nodeID), suffix)
+}
+
+// writeLock replaces the lock file atomically.
+func (l *filePullLocker) writeLock(fileName string, lock *filePullLock) error {
+	tempFileName := l.getTempFileName(fileName, "tmp")
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(tempFileName, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFileName, fileName)
+}
+
+// createLock creates the lock file atomically, it fails if the lock file
+// exists. Unlike O_EXCL, hard links are atomic on NFS as well.
+func (l *filePullLocker) createLock(fileName string, lock *filePullLock) error {
+	tempFileName := l.getTempFileName(fileName, "tmp")
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(tempFileName, content, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tempFileName)
+	return os.Link(tempFileName, fileName)
+}
+
+// isExpired returns whether the owner of the lock has gone. On a shared store
+// the owner may be any node, so the lock expires once the owner stops sending
+// heartbeats. On a node-local store the owner can only be this driver.
+func (l *filePullLocker) isExpired(fileName string, lock *filePullLock) bool {
+	if l.storeMode == storeModeLocal {
+		l.pullsMutex.Lock()
+		defer l.pullsMutex.Unlock()
+		_, ok := l.pulls[fileName]
+		return !ok
+	}
+	if lock.Owner == "" {
+		// Older versions of the driver send no heartbeats
+		return time.Since(lock.Heartbeat) > l.maxPublishDuration
+	}
+	return time.Since(lock.Heartbeat) > l.ttl
+}
+
+// lock writes the lock file in both store modes, so that pulls interrupted by
+// a crash are detected.
+func (l *filePullLocker) lock(image *ContainerImage, lost func()) (bool, error) {
+	if err := os.MkdirAll(progressDir, os.ModePerm); err != nil {
+		return false, fmt.Errorf("creating dir %s failed %s", progressDir, err.Error())
+	}
+	fileName := image.getLockFileName()
+	now := time.Now()
+	lock := filePullLock{
+		Owner:     l.nodeID,
+		Image:     image.Name,
+		Digest:    image.Digest,
+		Token:     now.UnixNano(),
+		Acquired:  now,
+		Heartbeat: now,
+	}
+
+	// Ensure that image is only processed once
+	tookOver := false
+	for {
+		err := l.createLock(fileName, &lock)
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			return false, err
+		}
+		previous, err := l.takeOver(fileName)
+		if os.IsNotExist(err) {
+			// Released in the meantime
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if previous.Token >= lock.Token {
+			lock.Token = previous.Token + 1
+		}
+		if err := l.createLock(fileName, &lock); err != nil {
+			return false, err
+		}
+		tookOver = true
+		break
+	}
+
+	l.pullsMutex.Lock()
+	l.pulls[fileName] = lock.Token
+	l.pullsMutex.Unlock()
+
+	go l.sendHeartbeats(fileName, lock.Token, lost)
+	return tookOver, nil
+}
+
+// takeOver removes the expired lock and returns it. The lock is renamed
+// first, so that only one node takes it over. It fails with a not exist error,
+// if the lock has been removed in the meantime.
+func (l *filePullLocker) takeOver(fileName string) (*filePullLock, error) {
+	current, err := readPullLock(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !l.isExpired(fileName, current) {
+		return nil, fmt.Errorf("image is being pulled by %s", current.Owner)
+	}
+
+	staleFileName := l.getTempFileName(fileName, "stale")
+	if err := os.Rename(fileName, staleFileName); err != nil {
+		return nil, err
+	}
+	defer os.Remove(staleFileName)
+	stale, err := readPullLock(staleFileName)
+	if err != nil {
+		return nil, err
+	}
+	if !l.isExpired(fileName, stale) {
+		// The lock has been renewed or taken over in the meantime
+		os.Link(staleFileName, fileName)
+		return nil, fmt.Errorf("image is being pulled by %s", stale.Owner)
+	}
+	return stale, nil
+}
+
+// sendHeartbeats renews the lock until the pull is unlocked or the lock is
+// lost.
+func (l *filePullLocker) sendHeartbeats(fileName string, token int64, lost func()) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.pullsMutex.Lock()
+		current, ok := l.pulls[fileName]
+		progress := l.progress[fileName]
+		l.pullsMutex.Unlock()
+		if !ok || current != token {
+			return
+		}
+
+		lock, err := l.readOwnLock(fileName, token)
+		if err == nil {
+			lock.Heartbeat = time.Now()
+			lock.Progress = progress
+			err = l.writeLock(fileName, lock)
+		}
+		if err == nil {
+			// Another node might have taken the lock over between reading and
+			// replacing it, the pull stops before it writes any further
+			_, err = l.readOwnLock(fileName, token)
+		}
+		if err != nil {
+			glog.Warningf("renewing lock %s failed %s\n", fileName, err.Error())
+			if os.IsNotExist(err) || err == errPullLockLost {
+				lost()
+				return
+			}
+		}
+	}
+}
+
+// readOwnLock reads the lock file and fails with errPullLockLost, unless it
+// carries the given token of this node.
+func (l *filePullLocker) readOwnLock(fileName string, token int64) (*filePullLock, error) {
+	lock, err := readPullLock(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if lock.Owner != l.nodeID || lock.Token != token {
+		return nil, errPullLockLost
+	}
+	return lock, nil
+}
+
+func (l *filePullLocker) verify(image *ContainerImage) error {
+	fileName := image.getLockFileName()
+	l.pullsMutex.Lock()
+	token, ok := l.pulls[fileName]
+	l.pullsMutex.Unlock()
+	if !ok {
+		return errPullLockLost
+	}
+	if _, err := l.readOwnLock(fileName, token); err != nil {
+		if os.IsNotExist(err) {
+			return errPullLockLost
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *filePullLocker) unlock(image *ContainerImage) {
+	fileName := image.getLockFileName()
+	if err := l.verify(image); err == nil {
+		os.Remove(fileName)
+	}
+
+	l.pullsMutex.Lock()
+	defer l.pullsMutex.Unlock()
+	delete(l.pulls, fileName)
+	delete(l.progress, fileName)
+}
+
+func (l *filePullLocker) inProgress(ctx context.Context, image *ContainerImage) (bool, time.Time) {
+	lock, err := readPullLock(image.getLockFileName())
+	if err != nil {
+		return false, time.Time{}
+	}
+	return true, lock.Acquired
+}
+
+func (l *filePullLocker) isStale(ctx context.Context, image *ContainerImage) bool {
+	fileName := image.getLockFileName()
+	lock, err := readPullLock(fileName)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return l.isExpired(fileName, lock)
+}
+
+// wait polls, as there is no portable way to watch files on a shared store.
+func (l *filePullLocker) wait(ctx context.Context, image *ContainerImage) {
+	timer := time.NewTimer(preparePollInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// recover releases the lock files of this node. On a node-local store all lock
+// files are owned by this node.
+func (l *filePullLocker) recover() ([]*ContainerImage, error) {
+	entries, err := os.ReadDir(progressDir)
+	if err != nil {
+		return nil, err
+	}
+	var images []*ContainerImage
+	ownTempSuffix := fmt.Sprintf("+%s+", encodeStoreKey(l.nodeID))
+	for _, entry := range entries {
+		fileName := path.Join(progressDir, entry.Name())
+		if strings.Contains(entry.Name(), "+") {
+			if strings.Contains(entry.Name(), ownTempSuffix) {
+				os.Remove(fileName)
+			}
+			continue
+		}
+		lock, err := readPullLock(fileName)
+		if err != nil || (lock.Owner != l.nodeID && l.storeMode != storeModeLocal) {
+			continue
+		}
+		glog.V(4).Infof("releasing lock %s of interrupted pull\n", fileName)
+		os.Remove(fileName)
+		if lock.Image != "" && lock.Digest != "" {
+			images = append(images, &ContainerImage{Name: lock.Image, Digest: lock.Digest})
+		}
+	}
+
+	return images, nil
+}
+
+func (l *filePullLocker) setProgress(image *ContainerImage, progress *pullProgress) {
+	fileName := image.getLockFileName()
+	l.pullsMutex.Lock()
+	defer l.pullsMutex.Unlock()
+	if _, ok := l.pulls[fileName]; ok {
+		l.progress[fileName] = progress
+	}
+}
+
+func (l *filePullLocker) getProgress(ctx context.Context, image *ContainerImage) (*pullProgress, error) {
+	lock, err := readPullLock(image.getLockFileName())
+	if err != nil {
+		return nil, err
+	}
+	return lock.Progress, nil
+}
+
+func (l *filePullLocker) list(ctx context.Context) ([]pullStatus, error) {
+	entries, err := os.ReadDir(progressDir)
+	if err != nil {
+		return nil, err
+	}
+	var pulls []pullStatus
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), "+") {
+			continue
+		}
+		fileName := path.Join(progressDir, entry.Name())
+		lock, err := readPullLock(fileName)
+		if err != nil {
+			continue
+		}
+		pulls = append(pulls, pullStatus{
+			Image:    lock.Image,
+			Digest:   lock.Digest,
+			Owner:    lock.Owner,
+			Acquired: lock.Acquired,
+			Stale:    l.isExpired(fileName, lock),
+			Progress: lock.Progress,
+		})
+	}
+	return pulls, nil
+}
@@ -0,0 +1,65 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestFilePullLocker(nodeID string, ttl time.Duration) *filePullLocker {
+	return newFilePullLocker(Config{NodeID: nodeID, StoreMode: storeModeShared, LockTTL: ttl, MaxPublishDuration: time.Hour})
+}
+
+func TestFileLockTakeOver(t *testing.T) {
+	progressDir = t.TempDir()
+	first := newTestFilePullLocker("node-a", 30*time.Millisecond)
+	second := newTestFilePullLocker("node-b", 30*time.Millisecond)
+
+	if _, err := first.lock(testLeaseImage, func() {}); err != nil {
+		t.Fatalf("locking failed %s", err.Error())
+	}
+	if _, err := second.lock(testLeaseImage, func() {}); err == nil {
+		t.Fatalf("lock held by another node has been acquired")
+	}
+
+	// The heartbeats of the first node stop, e.g. as it is partitioned
+	first.pullsMutex.Lock()
+	token := first.pulls[testLeaseImage.getLockFileName()]
+	delete(first.pulls, testLeaseImage.getLockFileName())
+	first.pullsMutex.Unlock()
+	time.Sleep(60 * time.Millisecond)
+
+	tookOver, err := second.lock(testLeaseImage, func() {})
+	if err != nil || !tookOver {
+		t.Fatalf("taking over expired lock returned %t %v", tookOver, err)
+	}
+	defer second.unlock(testLeaseImage)
+
+	// The first node resumes its heartbeats and finds out about the takeover
+	first.pullsMutex.Lock()
+	first.pulls[testLeaseImage.getLockFileName()] = token
+	first.pullsMutex.Unlock()
+	lost := make(chan struct{})
+	go first.sendHeartbeats(testLeaseImage.getLockFileName(), token, func() { close(lost) })
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("previous owner did not notice the takeover")
+	}
+	if err := second.verify(testLeaseImage); err != nil {
+		t.Errorf("verifying lock taken over failed %s", err.Error())
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pullLabels = []string{"image", "digest"}
+
+	pullBytesDesc = prometheus.NewDesc(
+		"image_extractor_pull_bytes",
+		"Compressed size of the layers of the image pulled.",
+		pullLabels, nil)
+	pullDownloadedBytesDesc = prometheus.NewDesc(
+		"image_extractor_pull_downloaded_bytes",
+		"Compressed bytes of the layers downloaded.",
+		pullLabels, nil)
+	pullExtractedBytesDesc = prometheus.NewDesc(
+		"image_extractor_pull_extracted_bytes",
+		"Compressed bytes of the layers extracted.",
+		pullLabels, nil)
+	pullLayersDesc = prometheus.NewDesc(
+		"image_extractor_pull_layers",
+		"Number of layers of the image pulled.",
+		pullLabels, nil)
+	pullCurrentLayerDesc = prometheus.NewDesc(
+		"image_extractor_pull_current_layer",
+		"1-based index of the layer being extracted, 0 while downloading.",
+		pullLabels, nil)
+	pullThroughputDesc = prometheus.NewDesc(
+		"image_extractor_pull_throughput_bytes_per_second",
+		"Throughput of the current phase of the pull.",
+		pullLabels, nil)
+	pullRemainingDesc = prometheus.NewDesc(
+		"image_extractor_pull_remaining_seconds",
+		"Estimated time until the pull is done.",
+		pullLabels, nil)
+	pullsQueuedDesc = prometheus.NewDesc(
+		"image_extractor_pulls_queued",
+		"Number of pulls waiting in the queue.",
+		nil, nil)
+	pullsRunningDesc = prometheus.NewDesc(
+		"image_extractor_pulls_running",
+		"Number of pulls running.",
+		nil, nil)
+)
+
+// pullCollector exposes the progress of the pulls of this driver. The pulls
+// are collected on every scrape, so that finished pulls disappear.
+type pullCollector struct {
+	ie *ImageExtractor
+}
+
+func (c *pullCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pullBytesDesc
+	ch <- pullDownloadedBytesDesc
+	ch <- pullExtractedBytesDesc
+	ch <- pullLayersDesc
+	ch <- pullCurrentLayerDesc
+	ch <- pullThroughputDesc
+	ch <- pullRemainingDesc
+	ch <- pullsQueuedDesc
+	ch <- pullsRunningDesc
+}
+
+func (c *pullCollector) Collect(ch chan<- prometheus.Metric) {
+	queued, running := c.ie.pullQueue.counts()
+	ch <- prometheus.MustNewConstMetric(pullsQueuedDesc, prometheus.GaugeValue, float64(queued))
+	ch <- prometheus.MustNewConstMetric(pullsRunningDesc, prometheus.GaugeValue, float64(running))
+
+	for _, job := range c.ie.getPullJobs() {
+		progress := job.tracker.getLastProgress()
+		if progress == nil {
+			continue
+		}
+		labels := []string{job.image.Name, job.image.getFullDigest()}
+		size, downloaded, extracted := progress.getTotals()
+		gauge := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+		}
+		gauge(pullBytesDesc, float64(size))
+		gauge(pullDownloadedBytesDesc, float64(downloaded))
+		gauge(pullExtractedBytesDesc, float64(extracted))
+		gauge(pullLayersDesc, float64(len(progress.Layers)))
+		gauge(pullCurrentLayerDesc, float64(progress.CurrentLayer))
+		gauge(pullThroughputDesc, float64(progress.Throughput))
+		if !progress.ETA.IsZero() {
+			gauge(pullRemainingDesc, time.Until(progress.ETA).Seconds())
+		}
+	}
+}
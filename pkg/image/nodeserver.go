@@ -31,7 +31,14 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	manifest "github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/manifest"
+)
+
+const (
+	// Suffix of the directory an image is copied to before it is moved into place
+	partialSuffix = ".partial"
+	// Suffix of the pins of staged volumes, which are kept until unstaged
+	stagedPinSuffix = ".staged"
 )
 
 func (ie *ImageExtractor) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -39,7 +46,7 @@ func (ie *ImageExtractor) NodeGetCapabilities(ctx context.Context, req *csi.Node
 		{
 			Type: &csi.NodeServiceCapability_Rpc{
 				Rpc: &csi.NodeServiceCapability_RPC{
-					Type: csi.NodeServiceCapability_RPC_UNKNOWN,
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 				},
 			},
 		},
@@ -68,19 +75,32 @@ func (ie *ImageExtractor) NodePublishVolume(ctx context.Context, req *csi.NodePu
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if err := validateId("volume id", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	image := req.GetVolumeContext()["image"]
-	containerImage, err := NewContainerImage(image)
-	if err != nil {
-		return nil, err
-	}
+	var sourcePath string
+	if stagingPath := req.GetStagingTargetPath(); len(stagingPath) > 0 {
+		// The image has been prepared by NodeStageVolume already
+		sourcePath = stagingPath
+	} else {
+		containerImage, err := ie.containerImageFromContext(ctx, req.GetVolumeContext())
+		if err != nil {
+			return nil, err
+		}
 
-	err = ie.setupVolume(req.GetVolumeId(), containerImage)
-	if err != nil {
-		return nil, err
+		containerImage, err = ie.setupTaggedVolume(ctx, req.GetVolumeId(), containerImage, req.GetVolumeContext())
+		if err != nil {
+			return nil, err
+		}
+		// Running pods keep their digest
+		if err := pinPublishedVolume(ie.config.NodeID, req.GetVolumeId(), req.GetTargetPath(), containerImage); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		sourcePath = ie.getVolumeSource(containerImage)
 	}
 
 	targetPath := req.GetTargetPath()
@@ -121,10 +141,9 @@ func (ie *ImageExtractor) NodePublishVolume(ctx context.Context, req *csi.NodePu
 		options = append(options, "ro")
 	}
 
-	path := containerImage.getExtractDestination()
 	mounter := mount.New("")
-	if err := mounter.Mount(path, targetPath, "", options); err != nil {
-		return nil, err
+	if err := mounter.Mount(sourcePath, targetPath, "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -135,6 +154,9 @@ func (ie *ImageExtractor) NodeUnpublishVolume(ctx context.Context, req *csi.Node
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if err := validateId("volume id", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
@@ -162,111 +184,401 @@ func (ie *ImageExtractor) NodeUnpublishVolume(ctx context.Context, req *csi.Node
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (ie ImageExtractor) extractImage(image *ContainerImage) {
-	if err := os.MkdirAll(progressDir, os.ModePerm); err != nil {
-		glog.V(4).Infof("creating dir %s failed %s\n", progressDir, err.Error())
+// startExtraction queues the extraction of the image and takes its lock once
+// the extraction starts. If workers is given, the extraction waits for a free
+// slot as well. If the digest is already being extracted by this driver, the
+// extraction is joined. The extraction is aborted, once the lock is lost or
+// the driver shuts down, queued extractions are removed from the queue.
+func (ie *ImageExtractor) startExtraction(image *ContainerImage, workers chan struct{}) {
+	job := ie.startPullJob(image)
+	if job == nil {
 		return
 	}
-	// Ensure that image is only processed once
-	touchFile(image.getLockFileName(), false)
+	ctx, cancel := context.WithCancel(ie.ctx)
+	lost := func() {
+		glog.V(4).Infof("lock of pull of %s lost, aborting\n", image.Name)
+		cancel()
+	}
+
+	// The pull is locked once it starts, so that other nodes are free to pull
+	// the image while it is queued
+	pull := ie.pullQueue.enqueue(image, workers)
+	go func() {
+		defer ie.finishPullJob(image, job)
+		defer cancel()
+		select {
+		case <-pull.start:
+		case <-ctx.Done():
+			if ie.pullQueue.cancel(pull) {
+				glog.V(4).Infof("queued pull of %s cancelled\n", image.Name)
+				return
+			}
+			// Started meanwhile
+		}
+		defer ie.pullQueue.release(pull)
+		if ctx.Err() != nil {
+			return
+		}
+		if err := ie.lockPull(ctx, image, lost); err != nil {
+			glog.V(4).Infof("locking pull of %s failed %s\n", image.Name, err.Error())
+			return
+		}
+		ie.extractImage(ctx, image, job.tracker)
+	}()
+}
+
+func (ie *ImageExtractor) extractImage(ctx context.Context, image *ContainerImage, tracker *pullTracker) {
+	started := time.Now()
+	committed := false
+	defer func() {
+		if !committed {
+			// The copy and the extraction are kept as checkpoint
+			ie.unlockPull(image)
+		}
+	}()
 
 	copyDir := image.getCopyDestination()
 	if err := os.MkdirAll(copyDir, os.ModePerm); err != nil {
 		glog.V(4).Infof("creating dir %s failed %s\n", copyDir, err.Error())
+		ie.failPull(image, storeError(err))
 		return
 	}
 
-	glog.V(4).Infof("Copy %s to %s\n", image.Name, copyDir)
-	source := fmt.Sprintf("docker://%s", image.Name)
-	destination := fmt.Sprintf("dir:%s", copyDir)
-	args := []string{"copy"}
-	authFile := os.Getenv("REGISTRY_AUTH_FILE")
-	if authFile != "" {
-		args = append(args, "--authfile", authFile)
+	// For multi-arch images the manifest of the platform is expected
+	var expected manifest.Manifest
+	err := ie.retryPull(ctx, image, "getting manifest", ie.config.ResolveTimeout, func(ctx context.Context) error {
+		var err error
+		expected, err = image.getImageManifest(ctx)
+		return classifyPullError(err, nil)
+	})
+	if err != nil {
+		glog.V(4).Infof("getting manifest of %s failed %s\n", image.Name, err.Error())
+		ie.failPull(image, err)
+		return
 	}
-	args = append(args, source, destination)
-	// TODO Check whether we can use github.com/containers/image/v5 for that
-	cmd := exec.Command("/bin/skopeo", args...)
-	stdoutStderr, err := cmd.CombinedOutput()
-	glog.V(4).Infof("skopeo copy image %s: %s\n", image.Name, stdoutStderr)
+	reservation, err := ie.admitPull(image, copyDir, expected)
 	if err != nil {
-		glog.V(4).Infof("copy image %s failed %s\n", image.Name, err.Error())
-		//TODO Cleanup
+		glog.V(4).Infof("admitting pull of %s failed %s\n", image.Name, err.Error())
+		ie.failPull(image, err)
 		return
 	}
+	defer ie.releaseSpace(reservation)
 
-	extractDir := image.getExtractDestination()
-	glog.V(4).Infof("Extract %s to %s\n", image.Name, extractDir)
-	if err := os.MkdirAll(extractDir, os.ModePerm); err != nil {
-		glog.V(4).Infof("creating dir %s failed %s\n", extractDir, err.Error())
+	blobs := getManifestBlobs(expected)
+	seedCopy(copyDir, blobs)
+
+	tracker.startDownload(copyDir, expected.LayerInfos())
+	done := make(chan struct{})
+	defer close(done)
+	go ie.reportProgress(image, tracker, done)
+
+	// Copy by the resolved digest, the tag might have moved in the meantime.
+	// Blobs already in the layout are not downloaded again.
+	repository, err := image.getRepository()
+	if err != nil {
+		glog.V(4).Infof("parsing image %s failed %s\n", image.Name, err.Error())
+		ie.failPull(image, &pullError{code: codes.InvalidArgument, permanent: true, message: err.Error()})
 		return
 	}
-
-	digestDir := image.getDigestDestination()
-	if err := os.MkdirAll(digestDir, os.ModePerm); err != nil {
-		glog.V(4).Infof("creating dir %s failed %s\n", digestDir, err.Error())
+	source := fmt.Sprintf("docker://%s@%s", repository, image.getFullDigest())
+	destination := fmt.Sprintf("oci:%s:%s", copyDir, image.Digest)
+	err = ie.retryPull(ctx, image, "copy", ie.config.DownloadTimeout, func(ctx context.Context) error {
+		glog.V(4).Infof("Copy %s to %s\n", source, copyDir)
+		removeIncompleteBlobs(copyDir)
+		cmd := skopeoCommand(ctx, "copy", source, destination)
+		stdoutStderr, err := cmd.CombinedOutput()
+		glog.V(4).Infof("skopeo copy image %s: %s\n", image.Name, stdoutStderr)
+		return classifyPullError(err, stdoutStderr)
+	})
+	if err != nil {
+		glog.V(4).Infof("copy image %s failed %s\n", image.Name, err.Error())
+		ie.failPull(image, err)
 		return
 	}
-	os.Symlink(extractDir, path.Join(digestDir, image.Digest))
 
-	manifestFile, err := os.ReadFile(path.Join(copyDir, "manifest.json"))
+	copied, err := image.readCopiedManifest(copyDir)
 	if err != nil {
-		glog.V(4).Infof("reading file %s failed %s\n", path.Join(copyDir, "manifest.json", copyDir), err.Error())
+		glog.V(4).Infof("reading manifest of %s failed %s\n", image.Name, err.Error())
+		ie.failPull(image, storeError(err))
 		return
 	}
-	manifest, err := manifest.FromBlob(manifestFile, manifest.GuessMIMEType(manifestFile))
+	if err := image.verifyCopiedManifest(copied, expected); err != nil {
+		glog.V(4).Infof("verifying image %s failed %s\n", image.Name, err.Error())
+		// Nothing of the copy can be trusted, the registry serves content not
+		// matching the digest
+		os.RemoveAll(copyDir)
+		ie.failPull(image, &pullError{code: codes.DataLoss, permanent: true, message: err.Error()})
+		return
+	}
+	if err := image.storeBlobs(copyDir, blobs); err != nil {
+		glog.V(4).Infof("storing blobs of %s failed %s\n", image.Name, err.Error())
+	}
+
+	// The extraction is renamed into place once complete
+	tempDir := image.getExtractTempDestination()
+	layers := copied.LayerInfos()
+	checkpoint, err := image.restoreCheckpoint(layers)
 	if err != nil {
-		glog.V(4).Infof("reading manifest %s failed %s\n", path.Join(copyDir, "manifest.json", copyDir), err.Error())
+		glog.V(4).Infof("restoring checkpoint of %s failed %s\n", image.Name, err.Error())
 		return
 	}
-	for _, layer := range manifest.LayerInfos() {
+	glog.V(4).Infof("Extract %s to %s from layer %d of %d\n", image.Name, tempDir, len(checkpoint.Layers)+1, len(layers))
+	tracker.startExtraction(len(checkpoint.Layers))
+	extractCtx := ctx
+	if ie.config.ExtractTimeout > 0 {
+		var cancel context.CancelFunc
+		extractCtx, cancel = context.WithTimeout(ctx, ie.config.ExtractTimeout)
+		defer cancel()
+	}
+	for i := len(checkpoint.Layers); i < len(layers); i++ {
+		layer := layers[i]
 		glog.V(4).Infof("extracting layer %s\n", layer.Digest)
-		err = extractTarGz(path.Join(copyDir, layer.Digest.Encoded()), extractDir)
+		err = extractLayerBlob(extractCtx, getLayoutBlobPath(copyDir, layer.Digest), tempDir, tracker, i)
 		if err != nil {
 			glog.V(4).Infof("extracting layer %s failed %s\n", layer.Digest.Encoded(), err.Error())
+			if extractCtx.Err() == nil {
+				ie.failPull(image, storeError(err))
+			}
+			return
+		}
+		checkpoint.Layers = append(checkpoint.Layers, layer.Digest.String())
+		if err := image.writeCheckpoint(checkpoint); err != nil {
+			glog.V(4).Infof("recording layer %s failed %s\n", layer.Digest.Encoded(), err.Error())
 			return
 		}
+	}
 
+	if err := ie.verifyPullLock(image); err != nil {
+		glog.V(4).Infof("committing %s failed %s\n", image.Name, err.Error())
+		return
+	}
+	extractDir := image.getExtractDestination()
+	if err := os.Rename(tempDir, extractDir); err != nil {
+		if _, statErr := os.Stat(extractDir); statErr != nil {
+			glog.V(4).Infof("renaming %s to %s failed %s\n", tempDir, extractDir, err.Error())
+			return
+		}
+		// The digest has been extracted for another image name meanwhile
+	}
+	committed = true
+	ie.recordPullDuration(time.Since(started))
+
+	digestDir := image.getDigestDestination()
+	if err := os.MkdirAll(digestDir, os.ModePerm); err != nil {
+		glog.V(4).Infof("creating dir %s failed %s\n", digestDir, err.Error())
+	}
+	os.Symlink(extractDir, path.Join(digestDir, image.Digest))
+
+	if err := writeExtractionSize(image.Digest); err != nil {
+		glog.V(4).Infof("recording size of %s failed %s\n", image.Name, err.Error())
 	}
 
 	// Cleaning up
-	os.RemoveAll(image.getCopyDestination())
-	os.Remove(image.getLockFileName())
+	os.Remove(image.getFailureFileName())
+	image.removeCheckpoint()
+	os.RemoveAll(copyDir)
+	ie.unlockPull(image)
 
 	glog.V(4).Infof("%s ready for consumption\n", image.Name)
 }
 
-func (ie *ImageExtractor) setupVolume(volumeId string, image *ContainerImage) error {
-	image.recordImageRequest()
-	if isPullInProgress, since := image.isPullInProgress(); isPullInProgress {
-		msg := fmt.Sprintf("image %s is beeing processed since %s", image.Name, since.Format(time.RFC3339Nano))
+func (ie *ImageExtractor) setupVolume(ctx context.Context, volumeId string, image *ContainerImage) error {
+	image.recordImageRequest(ie.config.PrefetchWindow)
+	err := ie.setupImage(ctx, image, nil)
+	if err != nil {
+		// A pod is waiting for the image
+		ie.pullQueue.boost(image.Digest)
+	}
+	return err
+}
+
+// setupImage ensures that the image gets extracted into the store. It returns
+// nil only if the image is ready for consumption.
+func (ie *ImageExtractor) setupImage(ctx context.Context, image *ContainerImage, workers chan struct{}) error {
+	if err := ie.getPullFailure(image); err != nil {
+		glog.V(4).Infof("%s\n", err.Error())
+		return err
+	} else if err := ie.getAdmissionFailure(image); err != nil {
+		glog.V(4).Infof("%s\n", err.Error())
+		return err
+	} else if ie.getPullJob(image) != nil {
+		msg := fmt.Sprintf("image %s is being processed by this node", image.Name)
+		if position, length := ie.pullQueue.position(image.Digest); position > 0 {
+			msg = fmt.Sprintf("image %s is queued for pull at position %d of %d", image.Name, position, length)
+		} else if progress := ie.getPullProgress(ctx, image); progress != nil {
+			msg = fmt.Sprintf("image %s is being processed by this node: %s", image.Name, progress)
+		}
+		glog.V(4).Infof("%s\n", msg)
+		_, since := ie.isPullInProgress(ctx, image)
+		return ie.pullInProgressError(ctx, image, since, msg)
+	} else if isPullInProgress, since := ie.isPullInProgress(ctx, image); isPullInProgress {
+		msg := fmt.Sprintf("image %s is being processed since %s", image.Name, since.Format(time.RFC3339Nano))
+		if progress := ie.getPullProgress(ctx, image); progress != nil {
+			msg = fmt.Sprintf("%s: %s", msg, progress)
+		}
 		glog.V(4).Infof("%s\n", msg)
-		if time.Since(since) > ie.config.MaxPublishDuration {
-			image.cleanup()
+		if ie.isPullStale(ctx, image) {
+			ie.startExtraction(image, workers)
+			return ie.pullInProgressError(ctx, image, time.Time{}, fmt.Sprintf("image pull %s taken over", image.Name))
+		}
+		return ie.pullInProgressError(ctx, image, since, msg)
+	} else if !ie.isExtracted(ctx, image) {
+		ie.startExtraction(image, workers)
+		if position, length := ie.pullQueue.position(image.Digest); position > 0 {
+			return ie.pullInProgressError(ctx, image, time.Time{}, fmt.Sprintf("image pull %s queued at position %d of %d", image.Name, position, length))
 		}
-		return fmt.Errorf("%s", msg)
-	} else if !image.isExtracted() {
-		go ie.extractImage(image)
-		return fmt.Errorf("image pull %s started", image.Name)
+		return ie.pullInProgressError(ctx, image, time.Time{}, fmt.Sprintf("image pull %s started", image.Name))
 	} else {
 		glog.V(4).Infof("image %s already pulled\n", image.Name)
+		image.recordImageUse()
 		return nil
 	}
 }
 
 func (ie *ImageExtractor) unsetupVolume(volumeId string) error {
 	// TODO Consider a setting to cleanup local directory
+	if err := unpinPublishedVolume(ie.config.NodeID, volumeId); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
 	return nil
 }
 
 func (ie *ImageExtractor) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if err := validateId("volume id", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(stagingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := unpinPublishedVolume(ie.config.NodeID, req.GetVolumeId()+stagedPinSuffix); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			return &csi.NodeUnstageVolumeResponse{}, nil
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		if err := mount.New("").Unmount(stagingPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		// Staged by copying the image
+		if err := os.RemoveAll(stagingPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	os.RemoveAll(stagingPath + partialSuffix)
+	glog.V(4).Infof("image: volume %s/%s has been unstaged.", stagingPath, req.GetVolumeId())
+
+	if err := unpinPublishedVolume(ie.config.NodeID, req.GetVolumeId()+stagedPinSuffix); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// NodeStageVolume does the heavy work once per node: the image is resolved,
+// pulled and extracted, and then either bind mounted or copied to the staging
+// path. Publishing is a bind mount from the staging path for each pod.
 func (ie *ImageExtractor) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if err := validateId("volume id", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+
+	stageMode := req.GetVolumeContext()[stageModeAttribute]
+	if stageMode == "" {
+		stageMode = stageModeBind
+	}
+	if stageMode != stageModeBind && stageMode != stageModeCopy {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %s", stageModeAttribute, stageMode)
+	}
+
+	containerImage, err := ie.containerImageFromContext(ctx, req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+
+	containerImage, err = ie.setupTaggedVolume(ctx, req.GetVolumeId(), containerImage, req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(stagingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err = os.MkdirAll(stagingPath, 0750); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if !notMnt {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	glog.V(4).Infof("staging %s to %s by %s\n", containerImage.Name, stagingPath, stageMode)
+	switch stageMode {
+	case stageModeBind:
+		// Pods on the node keep reading the digest from the store
+		if err := pinPublishedVolume(ie.config.NodeID, req.GetVolumeId()+stagedPinSuffix, stagingPath, containerImage); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		mounter := mount.New("")
+		if err := mounter.Mount(ie.getVolumeSource(containerImage), stagingPath, "", []string{"bind", "ro"}); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case stageModeCopy:
+		if err := copyToStagingPath(ie.getVolumeSource(containerImage), stagingPath); err != nil {
+			return nil, storeError(err)
+		}
+	}
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// copyToStagingPath copies the extraction next to the staging path first and
+// moves it into place once complete, so that an interrupted copy is never
+// mistaken for a staged volume.
+func copyToStagingPath(source string, stagingPath string) error {
+	if entries, err := os.ReadDir(stagingPath); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		// Staged already
+		return nil
+	}
+
+	partialPath := stagingPath + partialSuffix
+	if err := os.RemoveAll(partialPath); err != nil {
+		return err
+	}
+	cmd := exec.Command("cp", "-a", source, partialPath)
+	if stdoutStderr, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("copying %s to %s failed %s: %s", source, partialPath, err.Error(), stdoutStderr)
+	}
+	return os.Rename(partialPath, stagingPath)
+}
+
 func (ie *ImageExtractor) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
@@ -0,0 +1,256 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/mount-utils"
+)
+
+// volumePin records the digest a persistent volume has been provisioned with,
+// or the digest a volume is published with on a node. As long as the pin
+// exists the extraction of the digest must be kept.
+type volumePin struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+	// Path the volume is mounted to, set for published volumes only
+	TargetPath string `json:"targetPath,omitempty"`
+}
+
+// validateId rejects volume and snapshot ids, which are no single path
+// element, as they are used as file names in the store.
+func validateId(kind string, id string) error {
+	if id == "." || id == ".." || strings.ContainsAny(id, "/\x00") {
+		return status.Errorf(codes.InvalidArgument, "%s %q is invalid", kind, id)
+	}
+	return nil
+}
+
+func getPinFileName(volumeId string) string {
+	return path.Join(pinDir, volumeId)
+}
+
+func pinVolume(volumeId string, image *ContainerImage) error {
+	pin := volumePin{
+		Image:  image.Name,
+		Digest: image.getFullDigest(),
+	}
+	content, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getPinFileName(volumeId), content, 0644)
+}
+
+func readVolumePin(volumeId string) (*volumePin, error) {
+	return readPinFile(getPinFileName(volumeId))
+}
+
+func readPinFile(fileName string) (*volumePin, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var pin volumePin
+	if err := json.Unmarshal(content, &pin); err != nil {
+		return nil, err
+	}
+	return &pin, nil
+}
+
+func unpinVolume(volumeId string) error {
+	if err := os.Remove(getPinFileName(volumeId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func getPublishPinFileName(nodeId string, volumeId string) string {
+	return path.Join(publishDir, nodeId, volumeId)
+}
+
+// pinPublishedVolume records the digest of a volume published on the node,
+// so that running pods keep their digest.
+func pinPublishedVolume(nodeId string, volumeId string, targetPath string, image *ContainerImage) error {
+	if err := os.MkdirAll(path.Join(publishDir, nodeId), os.ModePerm); err != nil {
+		return err
+	}
+	pin := volumePin{
+		Image:      image.Name,
+		Digest:     image.getFullDigest(),
+		TargetPath: targetPath,
+	}
+	content, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getPublishPinFileName(nodeId, volumeId), content, 0644)
+}
+
+func unpinPublishedVolume(nodeId string, volumeId string) error {
+	if err := os.Remove(getPublishPinFileName(nodeId, volumeId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeStalePublishPins removes the pins of volumes of the node, which are
+// not mounted anymore, e.g. because the driver was down on unpublish.
+func removeStalePublishPins(nodeId string) {
+	nodeDir := path.Join(publishDir, nodeId)
+	entries, err := os.ReadDir(nodeDir)
+	if err != nil {
+		return
+	}
+	mounter := mount.New("")
+	for _, entry := range entries {
+		fileName := path.Join(nodeDir, entry.Name())
+		pin, err := readPinFile(fileName)
+		if err != nil {
+			continue
+		}
+		if notMnt, err := mounter.IsLikelyNotMountPoint(pin.TargetPath); (err == nil && notMnt) || os.IsNotExist(err) {
+			glog.V(4).Infof("removing stale pin of %s\n", pin.TargetPath)
+			os.Remove(fileName)
+		}
+	}
+}
+
+// imageSnapshot records the digest a volume was serving when the snapshot was
+// taken. Like volume pins, snapshots protect the extraction of the digest.
+type imageSnapshot struct {
+	Id             string    `json:"id"`
+	SourceVolumeId string    `json:"sourceVolumeId"`
+	Image          string    `json:"image"`
+	Digest         string    `json:"digest"`
+	CreationTime   time.Time `json:"creationTime"`
+}
+
+func getSnapshotFileName(snapshotId string) string {
+	return path.Join(snapshotDir, snapshotId)
+}
+
+func createSnapshot(snapshotId string, sourceVolumeId string, pin *volumePin) (*imageSnapshot, error) {
+	snapshot := imageSnapshot{
+		Id:             snapshotId,
+		SourceVolumeId: sourceVolumeId,
+		Image:          pin.Image,
+		Digest:         pin.Digest,
+		CreationTime:   time.Now(),
+	}
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(getSnapshotFileName(snapshotId), content, 0644); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func readSnapshot(snapshotId string) (*imageSnapshot, error) {
+	content, err := os.ReadFile(getSnapshotFileName(snapshotId))
+	if err != nil {
+		return nil, err
+	}
+	var snapshot imageSnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func listSnapshots() ([]*imageSnapshot, error) {
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*imageSnapshot
+	for _, entry := range entries {
+		snapshot, err := readSnapshot(entry.Name())
+		if err != nil {
+			// Deleted in the meantime
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+func deleteSnapshot(snapshotId string) error {
+	if err := os.Remove(getSnapshotFileName(snapshotId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (snapshot imageSnapshot) toCSISnapshot() *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snapshot.Id,
+		SourceVolumeId: snapshot.SourceVolumeId,
+		CreationTime:   timestamppb.New(snapshot.CreationTime),
+		// The snapshot consists of the pinned digest only
+		ReadyToUse: true,
+	}
+}
+
+// getPinnedDigests returns all digests pinned by volumes, snapshots or volumes
+// published on any node.
+func getPinnedDigests() (map[string]bool, error) {
+	pinned := map[string]bool{}
+
+	entries, err := os.ReadDir(pinDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if pin, err := readVolumePin(entry.Name()); err == nil {
+			pinned[pin.Digest] = true
+		}
+	}
+
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		pinned[snapshot.Digest] = true
+	}
+
+	err = filepath.Walk(publishDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if pin, err := readPinFile(name); err == nil {
+			pinned[pin.Digest] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
@@ -0,0 +1,46 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateId(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"pvc-2d4f8c1e-7a3b-4c5d-9e6f-0a1b2c3d4e5f", true},
+		{"csi-0123456789abcdef", true},
+		{"snapshot-1.2_3", true},
+		{"..", false},
+		{".", false},
+		{"../../etc/passwd", false},
+		{"a/b", false},
+		{"a\x00b", false},
+	}
+	for _, test := range tests {
+		err := validateId("volume id", test.id)
+		if test.valid && err != nil {
+			t.Errorf("validateId(%q) failed %s", test.id, err.Error())
+		} else if !test.valid && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("validateId(%q) returned %v, want InvalidArgument", test.id, err)
+		}
+	}
+}
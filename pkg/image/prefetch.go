@@ -0,0 +1,186 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// imagePopularity is the number of requests of an image within the prefetch
+// window, as recorded by recordImageRequest.
+type imagePopularity struct {
+	Name     string
+	Requests int
+}
+
+func (ie *ImageExtractor) runPrefetcher() {
+	for {
+		time.Sleep(ie.config.PrefetchInterval)
+		ie.prefetchImages()
+	}
+}
+
+// prefetchImages resolves the frequently requested tags and starts pulling
+// their digests, if they moved upstream and the budget allows.
+func (ie *ImageExtractor) prefetchImages() {
+	popular, err := ie.getPopularImages()
+	if err != nil {
+		glog.Errorf("reading request history failed %s", err.Error())
+		return
+	}
+
+	budget := ie.config.PrefetchBudget
+	started := 0
+	for _, image := range popular {
+		if len(ie.prefetchWorkers)+started >= cap(ie.prefetchWorkers) {
+			glog.V(4).Infof("prefetch concurrency exhausted\n")
+			return
+		}
+		if strings.Contains(image.Name, "@") {
+			// Digest references never move
+			continue
+		}
+
+		containerImage, err := ie.newContainerImage(ie.ctx, image.Name)
+		if err != nil {
+			glog.V(4).Infof("resolving %s for prefetch failed %s\n", image.Name, err.Error())
+			continue
+		}
+		if inProgress, _ := ie.isPullInProgress(ie.ctx, containerImage); inProgress || ie.isExtracted(ie.ctx, containerImage) {
+			continue
+		}
+		if err := ie.getPullFailure(containerImage); err != nil {
+			glog.V(4).Infof("skipping prefetch of %s: %s\n", image.Name, err.Error())
+			continue
+		}
+
+		if ie.config.PrefetchBudget > 0 {
+			ctx, cancel := context.WithTimeout(ie.ctx, ie.config.ResolveTimeout)
+			size, err := containerImage.getImageSize(ctx)
+			cancel()
+			if err != nil {
+				glog.V(4).Infof("getting size of %s for prefetch failed %s\n", image.Name, err.Error())
+				continue
+			}
+			if size > budget {
+				glog.V(4).Infof("prefetch budget exhausted, skipping %s with %d bytes\n", image.Name, size)
+				continue
+			}
+			budget -= size
+		}
+
+		glog.V(4).Infof("prefetching %s@%s requested %d times\n", image.Name, containerImage.getFullDigest(), image.Requests)
+		ie.startExtraction(containerImage, ie.prefetchWorkers)
+		started++
+	}
+}
+
+// getPopularImages returns the images requested at least PrefetchMinRequests
+// times within the prefetch window, the most popular first. Periods of the
+// request history outside the window are removed.
+func (ie *ImageExtractor) getPopularImages() ([]imagePopularity, error) {
+	entries, err := os.ReadDir(requestDir)
+	if err != nil {
+		return nil, err
+	}
+
+	currentPeriod := getRequestPeriod(time.Now(), ie.config.PrefetchWindow)
+	images := map[string]*imagePopularity{}
+	var keys []string
+	for _, entry := range entries {
+		fileName := path.Join(requestDir, entry.Name())
+		separator := strings.LastIndex(entry.Name(), "+")
+		if separator < 0 {
+			continue
+		}
+		key := entry.Name()[:separator]
+		period, err := strconv.ParseInt(entry.Name()[separator+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		// Requests are only appended to the current period, the window spans
+		// the current and the previous one
+		if period < currentPeriod-1 {
+			os.Remove(fileName)
+			continue
+		}
+
+		name, requests, err := ie.readRequestHistory(fileName)
+		if err != nil {
+			glog.V(4).Infof("reading request history %s failed %s\n", fileName, err.Error())
+			continue
+		}
+		image, ok := images[key]
+		if !ok {
+			image = &imagePopularity{}
+			images[key] = image
+			keys = append(keys, key)
+		}
+		if name != "" {
+			image.Name = name
+		}
+		image.Requests += requests
+	}
+
+	var popular []imagePopularity
+	for _, key := range keys {
+		if image := images[key]; image.Requests >= ie.config.PrefetchMinRequests {
+			popular = append(popular, *image)
+		}
+	}
+	sort.Slice(popular, func(i, j int) bool {
+		return popular[i].Requests > popular[j].Requests
+	})
+	return popular, nil
+}
+
+// readRequestHistory returns the image name and the number of requests within
+// the prefetch window of a period of the request history.
+func (ie *ImageExtractor) readRequestHistory(fileName string) (string, int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	name := ""
+	requests := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		requestTime, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil || time.Since(requestTime) > ie.config.PrefetchWindow {
+			continue
+		}
+		name = fields[1]
+		requests++
+	}
+	if err := scanner.Err(); err != nil {
+		return "", 0, err
+	}
+	return name, requests, nil
+}
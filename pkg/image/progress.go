@@ -0,0 +1,323 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// Interval in which the progress of the pulls of this driver is sampled
+	progressInterval = 5 * time.Second
+
+	pullPhaseQueued      = "queued"
+	pullPhaseDownloading = "downloading"
+	pullPhaseExtracting  = "extracting"
+)
+
+// layerProgress is the progress of a layer of a pull. Sizes are the
+// compressed sizes of the layer blobs.
+type layerProgress struct {
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+	Extracted  int64  `json:"extracted"`
+}
+
+// pullProgress is the progress of a pull. It is recorded in the pull lock, so
+// that every node can report it.
+type pullProgress struct {
+	Phase  string          `json:"phase"`
+	Layers []layerProgress `json:"layers,omitempty"`
+	// 1-based index of the layer being extracted
+	CurrentLayer int `json:"currentLayer,omitempty"`
+	// Bytes per second of the current phase
+	Throughput int64 `json:"throughput"`
+	// Estimated completion, assuming the current throughput for the rest of
+	// the pull
+	ETA     time.Time `json:"eta"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+}
+
+// getTotals returns the size of the layers and the bytes downloaded and
+// extracted.
+func (p *pullProgress) getTotals() (int64, int64, int64) {
+	var size, downloaded, extracted int64
+	for _, layer := range p.Layers {
+		size += layer.Size
+		downloaded += layer.Downloaded
+		extracted += layer.Extracted
+	}
+	return size, downloaded, extracted
+}
+
+func (p *pullProgress) String() string {
+	size, downloaded, extracted := p.getTotals()
+	var msg string
+	switch p.Phase {
+	case pullPhaseDownloading:
+		msg = fmt.Sprintf("downloading %s of %s", formatBytes(downloaded), formatBytes(size))
+	case pullPhaseExtracting:
+		msg = fmt.Sprintf("extracting layer %d of %d, %s of %s", p.CurrentLayer, len(p.Layers), formatBytes(extracted), formatBytes(size))
+	default:
+		return p.Phase
+	}
+	if p.Throughput > 0 {
+		msg += fmt.Sprintf(" at %s/s", formatBytes(p.Throughput))
+	}
+	if !p.ETA.IsZero() {
+		msg += fmt.Sprintf(", done in about %s", time.Until(p.ETA).Round(time.Second))
+	}
+	return msg
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// pullTracker tracks the progress of a pull of this driver.
+type pullTracker struct {
+	mutex    sync.Mutex
+	copyDir  string
+	progress pullProgress
+	// Bytes of the current phase at the last sample
+	sampledBytes int64
+	sampled      time.Time
+
+	// Compressed bytes of the current layer read by the extraction
+	layerRead int64
+}
+
+func newPullTracker() *pullTracker {
+	return &pullTracker{
+		progress: pullProgress{Phase: pullPhaseQueued},
+	}
+}
+
+// startDownload starts tracking the download of the layers into the copy.
+func (t *pullTracker) startDownload(copyDir string, layers []manifest.LayerInfo) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.copyDir = copyDir
+	t.progress.Layers = make([]layerProgress, len(layers))
+	for i, layer := range layers {
+		t.progress.Layers[i] = layerProgress{Digest: layer.Digest.String(), Size: layer.Size}
+		if layer.Size < 0 {
+			t.progress.Layers[i].Size = 0
+		}
+	}
+	t.progress.Started = time.Now()
+	// Blobs seeded from the store do not count into the throughput
+	t.progress.Phase = pullPhaseDownloading
+	t.sampleDownload()
+	t.setPhase(pullPhaseDownloading)
+}
+
+// startExtraction marks the layers as downloaded and the layers restored from
+// a checkpoint as extracted.
+func (t *pullTracker) startExtraction(extracted int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i := range t.progress.Layers {
+		layer := &t.progress.Layers[i]
+		layer.Downloaded = layer.Size
+		if i < extracted {
+			layer.Extracted = layer.Size
+		}
+	}
+	t.setPhase(pullPhaseExtracting)
+}
+
+func (t *pullTracker) setPhase(phase string) {
+	t.progress.Phase = phase
+	t.progress.Throughput = 0
+	t.sampledBytes = t.getPhaseBytes()
+	t.sampled = time.Now()
+}
+
+// startLayer returns a reader counting the bytes of the layer extracted.
+func (t *pullTracker) startLayer(index int, reader io.Reader) io.Reader {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.CurrentLayer = index + 1
+	atomic.StoreInt64(&t.layerRead, 0)
+	return &countingReader{reader: reader, count: &t.layerRead}
+}
+
+func (t *pullTracker) finishLayer(index int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	layer := &t.progress.Layers[index]
+	layer.Extracted = layer.Size
+}
+
+func (t *pullTracker) getPhaseBytes() int64 {
+	_, downloaded, extracted := t.progress.getTotals()
+	if t.progress.Phase == pullPhaseDownloading {
+		return downloaded
+	}
+	return extracted
+}
+
+// sample updates the progress from the copy and the extraction and returns a
+// snapshot of it.
+func (t *pullTracker) sample() *pullProgress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch t.progress.Phase {
+	case pullPhaseDownloading:
+		t.sampleDownload()
+	case pullPhaseExtracting:
+		if t.progress.CurrentLayer > 0 {
+			layer := &t.progress.Layers[t.progress.CurrentLayer-1]
+			if read := atomic.LoadInt64(&t.layerRead); read < layer.Size {
+				layer.Extracted = read
+			}
+		}
+	default:
+		return nil
+	}
+
+	now := time.Now()
+	bytes := t.getPhaseBytes()
+	if elapsed := now.Sub(t.sampled); elapsed > 0 {
+		rate := int64(float64(bytes-t.sampledBytes) / elapsed.Seconds())
+		if t.progress.Throughput > 0 {
+			rate = (t.progress.Throughput + rate) / 2
+		}
+		t.progress.Throughput = rate
+	}
+	t.sampledBytes = bytes
+	t.sampled = now
+
+	size, downloaded, extracted := t.progress.getTotals()
+	t.progress.ETA = time.Time{}
+	if t.progress.Throughput > 0 {
+		remaining := float64(2*size-downloaded-extracted) / float64(t.progress.Throughput)
+		t.progress.ETA = now.Add(time.Duration(remaining * float64(time.Second)))
+	}
+	t.progress.Updated = now
+	return t.getProgress()
+}
+
+// sampleDownload counts the blobs complete in the copy. Blobs being
+// downloaded cannot be told apart, their bytes are assigned to the missing
+// layers in order.
+func (t *pullTracker) sampleDownload() {
+	var partial int64
+	if entries, err := os.ReadDir(t.copyDir); err == nil {
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), "oci-put-blob") {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				partial += info.Size()
+			}
+		}
+	}
+	for i := range t.progress.Layers {
+		layer := &t.progress.Layers[i]
+		if _, err := os.Stat(getLayoutBlobPath(t.copyDir, digest.Digest(layer.Digest))); err == nil {
+			layer.Downloaded = layer.Size
+			continue
+		}
+		layer.Downloaded = partial
+		if layer.Downloaded > layer.Size {
+			layer.Downloaded = layer.Size
+		}
+		partial -= layer.Downloaded
+	}
+}
+
+// getProgress returns a snapshot of the last sample, nil while queued.
+func (t *pullTracker) getProgress() *pullProgress {
+	if t.progress.Phase == pullPhaseQueued {
+		return nil
+	}
+	progress := t.progress
+	progress.Layers = append([]layerProgress(nil), t.progress.Layers...)
+	return &progress
+}
+
+func (t *pullTracker) getLastProgress() *pullProgress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.getProgress()
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// reportProgress samples the progress of the pull and records it in the pull
+// lock until done is closed.
+func (ie *ImageExtractor) reportProgress(image *ContainerImage, tracker *pullTracker, done chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if progress := tracker.sample(); progress != nil {
+			glog.V(5).Infof("pull of %s %s\n", image.Name, progress)
+			ie.pullLocker.setProgress(image, progress)
+		}
+	}
+}
+
+// getPullProgress returns the progress of the pull of the image, nil if
+// unknown. Pulls of this driver are sampled locally, pulls of other nodes are
+// read from their pull lock.
+func (ie *ImageExtractor) getPullProgress(ctx context.Context, image *ContainerImage) *pullProgress {
+	if job := ie.getPullJob(image); job != nil {
+		return job.tracker.getLastProgress()
+	}
+	progress, err := ie.pullLocker.getProgress(ctx, image)
+	if err != nil {
+		glog.V(5).Infof("reading progress of %s failed %s\n", image.Name, err.Error())
+		return nil
+	}
+	return progress
+}
@@ -0,0 +1,181 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// queuedPull is a pull waiting in the queue, start is closed once it may run.
+type queuedPull struct {
+	digest   string
+	registry string
+	// Limits the pulls of the source of the pull, e.g. the prefetcher
+	workers  chan struct{}
+	sequence uint64
+	start    chan struct{}
+}
+
+// pullQueue schedules the pulls of this driver. Pulls start in FIFO order
+// within the global and per-registry concurrency limits, pulls of images pods
+// are waiting on are boosted ahead of the others.
+type pullQueue struct {
+	maxPulls         int
+	maxRegistryPulls int
+
+	mutex    sync.Mutex
+	queued   []*queuedPull
+	running  int
+	registry map[string]int
+	// Digests pods are waiting on
+	boosted  map[string]bool
+	sequence uint64
+}
+
+func newPullQueue(maxPulls int, maxRegistryPulls int) *pullQueue {
+	return &pullQueue{
+		maxPulls:         maxPulls,
+		maxRegistryPulls: maxRegistryPulls,
+		registry:         map[string]int{},
+		boosted:          map[string]bool{},
+	}
+}
+
+func (image ContainerImage) getRegistry() string {
+	named, err := reference.ParseNormalizedNamed(image.Name)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
+
+// enqueue queues the pull of the image. The pull must be released once done.
+func (q *pullQueue) enqueue(image *ContainerImage, workers chan struct{}) *queuedPull {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.sequence++
+	pull := &queuedPull{
+		digest:   image.Digest,
+		registry: image.getRegistry(),
+		workers:  workers,
+		sequence: q.sequence,
+		start:    make(chan struct{}),
+	}
+	q.queued = append(q.queued, pull)
+	q.dispatch()
+	return pull
+}
+
+func (q *pullQueue) release(pull *queuedPull) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.running--
+	q.registry[pull.registry]--
+	if q.registry[pull.registry] == 0 {
+		delete(q.registry, pull.registry)
+	}
+	if pull.workers != nil {
+		<-pull.workers
+	}
+	delete(q.boosted, pull.digest)
+	q.dispatch()
+}
+
+// cancel removes the pull from the queue. It returns false, if the pull has
+// been started already and must be released.
+func (q *pullQueue) cancel(pull *queuedPull) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, queued := range q.queued {
+		if queued == pull {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			delete(q.boosted, pull.digest)
+			return true
+		}
+	}
+	return false
+}
+
+// boost moves the pull of the digest ahead of the pulls nobody waits for.
+// Digests, which are not queued, are ignored.
+func (q *pullQueue) boost(digest string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, pull := range q.queued {
+		if pull.digest == digest {
+			q.boosted[digest] = true
+			q.sort()
+			return
+		}
+	}
+}
+
+// position returns the 1-based position of the digest in the queue and the
+// length of the queue. The position is 0, if the digest is not queued.
+func (q *pullQueue) position(digest string) (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, pull := range q.queued {
+		if pull.digest == digest {
+			return i + 1, len(q.queued)
+		}
+	}
+	return 0, len(q.queued)
+}
+
+// counts returns the number of queued and running pulls.
+func (q *pullQueue) counts() (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.queued), q.running
+}
+
+func (q *pullQueue) sort() {
+	sort.SliceStable(q.queued, func(i, j int) bool {
+		iBoosted, jBoosted := q.boosted[q.queued[i].digest], q.boosted[q.queued[j].digest]
+		if iBoosted != jBoosted {
+			return iBoosted
+		}
+		return q.queued[i].sequence < q.queued[j].sequence
+	})
+}
+
+// dispatch starts the queued pulls in order, as far as the limits allow. A
+// pull blocked by its registry or source does not block the pulls behind.
+func (q *pullQueue) dispatch() {
+	q.sort()
+	var queued []*queuedPull
+	for _, pull := range q.queued {
+		if q.running >= q.maxPulls || q.registry[pull.registry] >= q.maxRegistryPulls {
+			queued = append(queued, pull)
+			continue
+		}
+		if pull.workers != nil {
+			select {
+			case pull.workers <- struct{}{}:
+			default:
+				queued = append(queued, pull)
+				continue
+			}
+		}
+		q.running++
+		q.registry[pull.registry]++
+		close(pull.start)
+	}
+	q.queued = queued
+}
@@ -0,0 +1,157 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"testing"
+)
+
+func isStarted(pull *queuedPull) bool {
+	select {
+	case <-pull.start:
+		return true
+	default:
+		return false
+	}
+}
+
+func testImage(name string, digest string) *ContainerImage {
+	return &ContainerImage{Name: name, Digest: digest}
+}
+
+func TestPullQueueOrder(t *testing.T) {
+	q := newPullQueue(1, 1)
+	first := q.enqueue(testImage("a.io/first:latest", "1"), nil)
+	second := q.enqueue(testImage("b.io/second:latest", "2"), nil)
+	third := q.enqueue(testImage("c.io/third:latest", "3"), nil)
+
+	if !isStarted(first) || isStarted(second) || isStarted(third) {
+		t.Fatalf("only the first pull should have started")
+	}
+	if position, length := q.position("3"); position != 2 || length != 2 {
+		t.Errorf("position of third pull is %d of %d, want 2 of 2", position, length)
+	}
+
+	q.release(first)
+	if !isStarted(second) || isStarted(third) {
+		t.Errorf("second pull should start after the first")
+	}
+	q.release(second)
+	if !isStarted(third) {
+		t.Errorf("third pull should start after the second")
+	}
+	q.release(third)
+	if queued, running := q.counts(); queued != 0 || running != 0 {
+		t.Errorf("%d queued and %d running pulls left", queued, running)
+	}
+}
+
+func TestPullQueueBoost(t *testing.T) {
+	q := newPullQueue(1, 1)
+	running := q.enqueue(testImage("a.io/running:latest", "1"), nil)
+	prefetched := q.enqueue(testImage("b.io/prefetched:latest", "2"), nil)
+	waited := q.enqueue(testImage("c.io/waited:latest", "3"), nil)
+
+	q.boost("3")
+	if position, _ := q.position("3"); position != 1 {
+		t.Errorf("boosted pull at position %d, want 1", position)
+	}
+	q.release(running)
+	if !isStarted(waited) || isStarted(prefetched) {
+		t.Errorf("boosted pull should start before the pull queued earlier")
+	}
+
+	// Digests not queued are not recorded
+	q.boost("1")
+	q.boost("unknown")
+	if len(q.boosted) != 1 || !q.boosted["3"] {
+		t.Errorf("boosted digests %v, want only the queued digest 3", q.boosted)
+	}
+	q.release(waited)
+	if len(q.boosted) != 0 {
+		t.Errorf("boosted digests %v left after release", q.boosted)
+	}
+	q.release(prefetched)
+}
+
+func TestPullQueueLimits(t *testing.T) {
+	q := newPullQueue(3, 2)
+	a1 := q.enqueue(testImage("a.io/one:latest", "a1"), nil)
+	a2 := q.enqueue(testImage("a.io/two:latest", "a2"), nil)
+	a3 := q.enqueue(testImage("a.io/three:latest", "a3"), nil)
+	b1 := q.enqueue(testImage("b.io/one:latest", "b1"), nil)
+	b2 := q.enqueue(testImage("b.io/two:latest", "b2"), nil)
+
+	// The registry limit blocks a3, but not the pulls of b.io behind it
+	if !isStarted(a1) || !isStarted(a2) || isStarted(a3) || !isStarted(b1) {
+		t.Fatalf("registry limit not applied")
+	}
+	// The global limit blocks b2
+	if isStarted(b2) {
+		t.Fatalf("global limit not applied")
+	}
+	if queued, running := q.counts(); queued != 2 || running != 3 {
+		t.Errorf("%d queued and %d running pulls, want 2 and 3", queued, running)
+	}
+
+	q.release(b1)
+	if isStarted(a3) || !isStarted(b2) {
+		t.Errorf("b2 should start, a3 is still limited by its registry")
+	}
+	q.release(a1)
+	if !isStarted(a3) {
+		t.Errorf("a3 should start once its registry has room")
+	}
+}
+
+func TestPullQueueWorkers(t *testing.T) {
+	q := newPullQueue(2, 2)
+	workers := make(chan struct{}, 1)
+	first := q.enqueue(testImage("a.io/first:latest", "1"), workers)
+	second := q.enqueue(testImage("a.io/second:latest", "2"), workers)
+	other := q.enqueue(testImage("a.io/other:latest", "3"), nil)
+
+	if !isStarted(first) || isStarted(second) || !isStarted(other) {
+		t.Fatalf("worker limit of the source not applied")
+	}
+	q.release(first)
+	if !isStarted(second) {
+		t.Errorf("second pull should start once a worker is free")
+	}
+}
+
+func TestPullQueueCancel(t *testing.T) {
+	q := newPullQueue(1, 1)
+	running := q.enqueue(testImage("a.io/running:latest", "1"), nil)
+	queued := q.enqueue(testImage("a.io/queued:latest", "2"), nil)
+	q.boost("2")
+
+	if q.cancel(running) {
+		t.Errorf("running pull has been cancelled")
+	}
+	if !q.cancel(queued) {
+		t.Errorf("queued pull has not been cancelled")
+	}
+	if position, length := q.position("2"); position != 0 || length != 0 {
+		t.Errorf("cancelled pull still queued at %d of %d", position, length)
+	}
+	if len(q.boosted) != 0 {
+		t.Errorf("boosted digests %v left after cancel", q.boosted)
+	}
+	q.release(running)
+	if isStarted(queued) {
+		t.Errorf("cancelled pull has been started")
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Pull policies, deciding when a tag is resolved against the registry.
+const (
+	// The tag is resolved on every publish
+	pullPolicyAlways = "Always"
+	// The cached resolution is used within its TTL. If the registry is not
+	// reachable afterwards, an extracted cached digest is used.
+	pullPolicyIfNotPresent = "IfNotPresent"
+	// The registry is never contacted, the cached digest must be extracted
+	pullPolicyNever = "Never"
+)
+
+func (image ContainerImage) getResolveFileName() string {
+	return path.Join(resolveDir, image.getFileName())
+}
+
+// recordResolution caches the digest the tag has been resolved to. The
+// modification time of the file is the time of the resolution.
+func (image ContainerImage) recordResolution() error {
+	tmpFileName := image.getResolveFileName() + partialSuffix
+	if err := os.WriteFile(tmpFileName, []byte(image.getFullDigest()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, image.getResolveFileName())
+}
+
+// getCachedResolution returns the image with the cached digest of the tag
+// and the time of the resolution.
+func getCachedResolution(name string) (*ContainerImage, time.Time, error) {
+	fileName := ContainerImage{Name: name}.getResolveFileName()
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	image, err := newPinnedContainerImage(name, strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return image, info.ModTime(), nil
+}
+
+// getDigestReferenceImage returns the image, if it is referenced by digest.
+func getDigestReferenceImage(name string) *ContainerImage {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil
+	}
+	canonical, ok := named.(reference.Canonical)
+	if !ok {
+		return nil
+	}
+	image, err := newPinnedContainerImage(name, canonical.Digest().String())
+	if err != nil {
+		return nil
+	}
+	return image
+}
+
+// hasCompleteExtraction returns whether the digest is fully extracted. The
+// size is recorded once the extraction is complete.
+func (image ContainerImage) hasCompleteExtraction() bool {
+	_, err := readExtractionSize(image.Digest)
+	return err == nil
+}
+
+// resolveContainerImage resolves the image according to the pull policy.
+// Digest references never touch the registry once extracted.
+func (ie *ImageExtractor) resolveContainerImage(ctx context.Context, name string, pullPolicy string) (*ContainerImage, error) {
+	name, err := normalizeImageName(name)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid image %s", err.Error())
+	}
+	if image := getDigestReferenceImage(name); image != nil && image.hasCompleteExtraction() {
+		return image, nil
+	}
+
+	switch pullPolicy {
+	case pullPolicyAlways:
+		return ie.newContainerImage(ctx, name)
+	case pullPolicyIfNotPresent:
+		cached, resolved, err := getCachedResolution(name)
+		if err == nil && time.Since(resolved) < ie.config.ResolveCacheTTL {
+			return cached, nil
+		}
+		image, err := ie.newContainerImage(ctx, name)
+		if err != nil && cached != nil && cached.hasCompleteExtraction() {
+			glog.V(4).Infof("resolving %s failed, using cached digest %s: %s\n", name, cached.getFullDigest(), err.Error())
+			return cached, nil
+		}
+		return image, err
+	case pullPolicyNever:
+		cached, _, err := getCachedResolution(name)
+		if err != nil || !cached.hasCompleteExtraction() {
+			return nil, status.Errorf(codes.NotFound, "image %s not present with pull policy %s", name, pullPolicyNever)
+		}
+		return cached, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %s", pullPolicyAttribute, pullPolicy)
+	}
+}
@@ -61,6 +61,7 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 }
 
 func (s *nonBlockingGRPCServer) serve(ep string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	defer s.wg.Done()
 	listener, cleanup, err := endpoint.Listen(ep)
 	if err != nil {
 		glog.Fatalf("Failed to listen: %v", err)
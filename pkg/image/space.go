@@ -0,0 +1,182 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/golang/glog"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Delay until a pull denied admission is admitted again, the store might
+// have room then, e.g. because running pulls are done
+const admissionRetryDelay = time.Minute
+
+// admissionFailure is a pull denied admission, it is kept in memory only, as
+// the lack of space is temporary.
+type admissionFailure struct {
+	message string
+	time    time.Time
+}
+
+// spaceReservation is the space in the store admitted to a pull.
+type spaceReservation struct {
+	// Bytes of the blobs to download and of the extraction
+	download   int64
+	extraction int64
+}
+
+func (r spaceReservation) getTotal() int64 {
+	return r.download + r.extraction
+}
+
+// getFreeSpace returns the bytes available on the filesystem of the store.
+func getFreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// estimateSpace estimates the space the pull of the image needs in the
+// store. Blobs already in the copy or in the blob store are not downloaded
+// again, extracted layers are estimated by the expansion ratio.
+func (ie *ImageExtractor) estimateSpace(copyDir string, imageManifest manifest.Manifest) spaceReservation {
+	var reservation spaceReservation
+	config := imageManifest.ConfigInfo()
+	blobs := append([]manifest.LayerInfo{{BlobInfo: config}}, imageManifest.LayerInfos()...)
+	for i, blob := range blobs {
+		if blob.Size <= 0 {
+			continue
+		}
+		if i > 0 {
+			reservation.extraction += int64(float64(blob.Size) * ie.config.ExpansionRatio)
+		}
+		if _, err := os.Stat(getLayoutBlobPath(copyDir, blob.Digest)); err == nil {
+			continue
+		}
+		if _, err := os.Stat(getBlobPath(blob.Digest)); err == nil {
+			continue
+		}
+		reservation.download += blob.Size
+	}
+	return reservation
+}
+
+// checkSpace returns how many bytes are missing in the store for the
+// reservation, considering the free space of the filesystem and the store
+// capacity, minus the space reserved by the pulls running already. Running
+// pulls keep their reservation until done, even though they have used part
+// of it already.
+func (ie *ImageExtractor) checkSpace(reservation spaceReservation) (int64, error) {
+	free, err := getFreeSpace(ie.config.ImageStoreDir)
+	if err != nil {
+		return 0, err
+	}
+	missing := reservation.getTotal() - (free - ie.reservedSpace.getTotal())
+
+	if ie.config.StoreCapacity > 0 {
+		extractions, err := ie.listExtractions()
+		if err != nil {
+			return 0, err
+		}
+		usage := ie.reservedSpace.extraction + reservation.extraction
+		for _, extraction := range extractions {
+			usage += extraction.Size
+		}
+		if exceeding := usage - ie.config.StoreCapacity; exceeding > missing {
+			missing = exceeding
+		}
+	}
+	return missing, nil
+}
+
+// admitPull reserves the space the pull of the image needs in the store. If
+// the store lacks room, the least recently used extractions are evicted.
+// Pulls, which still do not fit, fail with ResourceExhausted instead of
+// filling the store for all other images. The failure is not cached in the
+// store, the pull is admitted again after the admission retry delay.
+// Reservations are per process, concurrent pulls of other drivers sharing
+// the store are only accounted for by the free space they have used already.
+func (ie *ImageExtractor) admitPull(image *ContainerImage, copyDir string, imageManifest manifest.Manifest) (spaceReservation, error) {
+	reservation := ie.estimateSpace(copyDir, imageManifest)
+
+	// Admissions are serialized, so that concurrent pulls do not count on the
+	// same space
+	ie.spaceMutex.Lock()
+	defer ie.spaceMutex.Unlock()
+	missing, err := ie.checkSpace(reservation)
+	if err != nil {
+		return spaceReservation{}, storeError(err)
+	}
+	if missing > 0 {
+		glog.V(4).Infof("store lacks %d bytes for pull of %s, evicting extractions\n", missing, image.Name)
+		if err := ie.evictExtractions(missing); err != nil {
+			glog.V(4).Infof("evicting extractions failed %s\n", err.Error())
+		}
+		if missing, err = ie.checkSpace(reservation); err != nil {
+			return spaceReservation{}, storeError(err)
+		}
+	}
+	if missing > 0 {
+		message := fmt.Sprintf("store lacks %s for pull of %s needing %s", formatBytes(missing), image.Name, formatBytes(reservation.getTotal()))
+		ie.admissionFailures[image.Digest] = admissionFailure{message: message, time: time.Now()}
+		return spaceReservation{}, &pullError{code: codes.ResourceExhausted, message: message}
+	}
+	delete(ie.admissionFailures, image.Digest)
+
+	ie.reservedSpace.download += reservation.download
+	ie.reservedSpace.extraction += reservation.extraction
+	return reservation, nil
+}
+
+// getAdmissionFailure returns ResourceExhausted with a RetryInfo detail, if
+// the pull of the image has been denied admission within the admission retry
+// delay.
+func (ie *ImageExtractor) getAdmissionFailure(image *ContainerImage) error {
+	ie.spaceMutex.Lock()
+	defer ie.spaceMutex.Unlock()
+	failure, ok := ie.admissionFailures[image.Digest]
+	if !ok {
+		return nil
+	}
+	remaining := admissionRetryDelay - time.Since(failure.time)
+	if remaining <= 0 {
+		delete(ie.admissionFailures, image.Digest)
+		return nil
+	}
+	st := status.New(codes.ResourceExhausted, failure.message)
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(remaining)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// releaseSpace releases the space reserved for a pull once it is done.
+func (ie *ImageExtractor) releaseSpace(reservation spaceReservation) {
+	ie.spaceMutex.Lock()
+	defer ie.spaceMutex.Unlock()
+	ie.reservedSpace.download -= reservation.download
+	ie.reservedSpace.extraction -= reservation.extraction
+}
@@ -0,0 +1,522 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// Version of the store layout
+//
+//	0: image names with '/' replaced by '_' as keys
+//	1: normalized image names encoded by encodeStoreKey as keys
+//	2: request history rotated per prefetch window
+//	3: pull locks, copies and checkpoints keyed by digest
+const storeVersion = 3
+
+func getStoreVersion(imageStoreDir string) (int, error) {
+	content, err := os.ReadFile(path.Join(imageStoreDir, "version"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// migrateStore migrates the store to the current layout. Drivers starting
+// at the same time migrate the store one after the other.
+func migrateStore(imageStoreDir string, maxPublishDuration, prefetchWindow time.Duration) error {
+	version, err := getStoreVersion(imageStoreDir)
+	if err != nil {
+		return err
+	}
+	if version == storeVersion {
+		return nil
+	}
+
+	unlock, err := lockStore(imageStoreDir, maxPublishDuration)
+	if err != nil {
+		return fmt.Errorf("locking store failed %s", err.Error())
+	}
+	defer unlock()
+	// Another driver might have migrated the store meanwhile
+	if version, err = getStoreVersion(imageStoreDir); err != nil {
+		return err
+	}
+	if version > storeVersion {
+		return fmt.Errorf("store version %d is newer than supported version %d", version, storeVersion)
+	} else if version == storeVersion {
+		return nil
+	}
+
+	if version < 1 {
+		glog.Infof("migrating store %s to version 1", imageStoreDir)
+		if err := migrateStoreKeys(maxPublishDuration); err != nil {
+			return err
+		}
+	}
+	if version < 2 {
+		glog.Infof("migrating store %s to version 2", imageStoreDir)
+		if err := migrateRequestHistory(prefetchWindow); err != nil {
+			return err
+		}
+	}
+	if version < 3 {
+		glog.Infof("migrating store %s to version 3", imageStoreDir)
+		if err := migratePullKeys(maxPublishDuration); err != nil {
+			return err
+		}
+	}
+
+	return os.WriteFile(path.Join(imageStoreDir, "version"), []byte(strconv.Itoa(storeVersion)), 0644)
+}
+
+// lockStore takes the store-wide lock for its migration and returns the
+// function releasing it. The lock file is created atomically by a hard link,
+// like the pull locks. A lock older than the maximum publish duration is
+// considered left behind by a crashed driver and removed.
+func lockStore(imageStoreDir string, maxPublishDuration time.Duration) (func(), error) {
+	fileName := path.Join(imageStoreDir, "migrate.lock")
+	tempFileName := fmt.Sprintf("%s+%d+%d", fileName, os.Getpid(), time.Now().UnixNano())
+	for {
+		if err := os.WriteFile(tempFileName, nil, 0644); err != nil {
+			return nil, err
+		}
+		err := os.Link(tempFileName, fileName)
+		os.Remove(tempFileName)
+		if err == nil {
+			return func() { os.Remove(fileName) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(fileName); err == nil && time.Since(info.ModTime()) > maxPublishDuration {
+			glog.Infof("removing stale store lock %s", fileName)
+			os.Remove(fileName)
+			continue
+		}
+		glog.V(4).Infof("waiting for migration of store %s by another driver\n", imageStoreDir)
+		time.Sleep(time.Second)
+	}
+}
+
+// migrateStoreKeys moves the entries keyed by image name to the keys of the
+// normalized image names. Entries, whose image name cannot be recovered, are
+// removed.
+func migrateStoreKeys(maxPublishDuration time.Duration) error {
+	// The digest links and the request history record the image names, the
+	// keys themselves are the last resort
+	names, err := readLegacyDigestLinkNames()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(requestDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		oldFileName := path.Join(requestDir, entry.Name())
+		name, requests, err := readLegacyRequestHistory(oldFileName)
+		if err == nil && name == "" {
+			name, err = getLegacyImageName(names, entry.Name())
+		}
+		if err != nil {
+			os.Remove(oldFileName)
+			continue
+		}
+		names[entry.Name()] = name
+		// Request files of the initial layout are empty and only touched
+		if len(requests) == 0 {
+			if info, err := entry.Info(); err == nil {
+				requests = []string{fmt.Sprintf("%s %s", info.ModTime().Format(time.RFC3339Nano), name)}
+			}
+		}
+		newFileName := path.Join(requestDir, ContainerImage{Name: name}.getFileName())
+		if err := appendLines(newFileName, requests); err != nil {
+			return err
+		}
+		os.Remove(oldFileName)
+	}
+
+	entries, err = os.ReadDir(historyDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		oldFileName := path.Join(historyDir, entry.Name())
+		if name, ok := names[entry.Name()]; ok {
+			os.Rename(oldFileName, ContainerImage{Name: name}.getHistoryFileName())
+		} else {
+			os.Remove(oldFileName)
+		}
+	}
+
+	// Cached resolutions are resolved again
+	entries, err = os.ReadDir(resolveDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		os.Remove(path.Join(resolveDir, entry.Name()))
+	}
+
+	if err := migrateDigestLinks(); err != nil {
+		return err
+	}
+
+	if err := migrateLocks(names, maxPublishDuration); err != nil {
+		return err
+	}
+
+	// Copies of pulls in progress are left to their owners
+	entries, err = os.ReadDir(copyDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > maxPublishDuration {
+			os.RemoveAll(path.Join(copyDir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// migrateLocks moves the pull locks of older versions to the keys of the
+// normalized image names, so that drivers of this version do not pull the
+// image again while the lock is held. Expired locks and locks, whose image
+// name cannot be recovered, are removed. Moved locks are not renewed by their
+// owner anymore and expire as well.
+func migrateLocks(names map[string]string, maxPublishDuration time.Duration) error {
+	entries, err := os.ReadDir(progressDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		oldFileName := path.Join(progressDir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > maxPublishDuration {
+			os.RemoveAll(oldFileName)
+			continue
+		}
+
+		name, err := getLegacyImageName(names, entry.Name())
+		if lock, readErr := readPullLock(oldFileName); readErr == nil && lock.Image != "" {
+			name, err = normalizeImageName(lock.Image)
+		}
+		if err != nil {
+			glog.Infof("removing lock %s of unknown image", oldFileName)
+			os.RemoveAll(oldFileName)
+			continue
+		}
+		// Version 1 keyed the locks by image name as well
+		newFileName := path.Join(progressDir, ContainerImage{Name: name}.getFileName())
+		if newFileName == oldFileName {
+			continue
+		}
+		// Hard links keep the heartbeat of the lock
+		if err := os.Link(oldFileName, newFileName); err != nil && !os.IsExist(err) {
+			return err
+		}
+		os.Remove(oldFileName)
+	}
+	return nil
+}
+
+// migratePullKeys moves the pull locks keyed by image name to the digests they
+// record. Locks of the initial layout record no digest, the initial layout
+// linked the digest before extracting it though, so the latest digest link of
+// the image is taken. Locks, whose digest cannot be recovered, are removed.
+// Copies and checkpoints keyed by image name are not continued and removed
+// once stale.
+func migratePullKeys(maxPublishDuration time.Duration) error {
+	entries, err := os.ReadDir(progressDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), "+") {
+			continue
+		}
+		oldFileName := path.Join(progressDir, entry.Name())
+		lock, err := readPullLock(oldFileName)
+		if err != nil {
+			continue
+		}
+		pullKey := lock.Digest
+		if pullKey == "" {
+			pullKey = getLatestDigestLink(path.Join(digestDir, entry.Name()))
+		}
+		if digest.NewDigestFromEncoded(digest.SHA256, pullKey).Validate() != nil || time.Since(lock.Heartbeat) > maxPublishDuration {
+			glog.Infof("removing lock %s of unknown digest", oldFileName)
+			os.Remove(oldFileName)
+			continue
+		}
+		newFileName := ContainerImage{Digest: pullKey}.getLockFileName()
+		if newFileName == oldFileName {
+			continue
+		}
+		// Hard links keep the heartbeat of the lock
+		if err := os.Link(oldFileName, newFileName); err != nil && !os.IsExist(err) {
+			return err
+		}
+		os.Remove(oldFileName)
+	}
+	return nil
+}
+
+// getLatestDigestLink returns the digest linked last in the digest directory
+// of an image.
+func getLatestDigestLink(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	latest := ""
+	var modified time.Time
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().After(modified) {
+			latest, modified = entry.Name(), info.ModTime()
+		}
+	}
+	return latest
+}
+
+// migrateRequestHistory moves the request history of every image into the
+// period of its last request.
+func migrateRequestHistory(prefetchWindow time.Duration) error {
+	entries, err := os.ReadDir(requestDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), "+") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		oldFileName := path.Join(requestDir, entry.Name())
+		period := getRequestPeriod(info.ModTime(), prefetchWindow)
+		newFileName := path.Join(requestDir, fmt.Sprintf("%s+%d", entry.Name(), period))
+		if err := os.Rename(oldFileName, newFileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLegacyRequestHistory returns the normalized image name and the requests
+// with normalized image names.
+func readLegacyRequestHistory(fileName string) (string, []string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	name := ""
+	var requests []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if name, err = normalizeImageName(fields[1]); err != nil {
+			return "", nil, err
+		}
+		requests = append(requests, fmt.Sprintf("%s %s", fields[0], name))
+	}
+	return name, requests, scanner.Err()
+}
+
+// getLegacyImageName returns the normalized image name of the key of an older
+// version. Keys, whose image name is not known, are mapped back by replacing
+// '_' with '/' as the initial layout did the opposite.
+func getLegacyImageName(names map[string]string, key string) (string, error) {
+	if name, ok := names[key]; ok {
+		return name, nil
+	}
+	return normalizeImageName(strings.ReplaceAll(key, "_", "/"))
+}
+
+// readLegacyDigestLinkNames returns the normalized image names of the links
+// digest/<image name>/<digest> by the keys of the initial layout.
+func readLegacyDigestLinkNames() (map[string]string, error) {
+	names := map[string]string{}
+	err := filepath.Walk(digestDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		relative, err := filepath.Rel(digestDir, path.Dir(name))
+		if err != nil {
+			return nil
+		}
+		if normalized, err := normalizeImageName(relative); err == nil {
+			names[strings.ReplaceAll(relative, "/", "_")] = normalized
+		}
+		return nil
+	})
+	return names, err
+}
+
+// migrateDigestLinks moves the links digest/<image name>/<digest> to
+// digest/<key>/<digest>.
+func migrateDigestLinks() error {
+	var links []string
+	err := filepath.Walk(digestDir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			links = append(links, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		relative, err := filepath.Rel(digestDir, link)
+		if err != nil {
+			continue
+		}
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		os.Remove(link)
+		name, err := normalizeImageName(path.Dir(relative))
+		if err != nil {
+			continue
+		}
+		newDir := ContainerImage{Name: name}.getDigestDestination()
+		if err := os.MkdirAll(newDir, os.ModePerm); err != nil {
+			return err
+		}
+		os.Symlink(target, path.Join(newDir, path.Base(relative)))
+	}
+
+	// Remove the directories left empty
+	entries, err := os.ReadDir(digestDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		removeEmptyDirs(path.Join(digestDir, entry.Name()))
+	}
+	return nil
+}
+
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeEmptyDirs(path.Join(dir, entry.Name()))
+		}
+	}
+	// Fails for directories, which are not empty
+	os.Remove(dir)
+}
+
+func appendLines(fileName string, lines []string) error {
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(file, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverPulls releases the locks of the pulls of this node interrupted by a
+// restart and resumes them from their checkpoints. Checkpoints of pulls,
+// which have not been continued within the maximum publish duration, are
+// removed.
+func (ie *ImageExtractor) recoverPulls() error {
+	if err := ie.removeStaleCheckpoints(); err != nil {
+		return err
+	}
+
+	images, err := ie.pullLocker.recover()
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if ie.isExtracted(ie.ctx, image) {
+			continue
+		}
+		glog.V(4).Infof("resuming interrupted pull of %s\n", image.Name)
+		ie.startExtraction(image, nil)
+	}
+	return nil
+}
+
+// removeStaleCheckpoints removes the copies and temp dirs of the store, which
+// have not been modified within the maximum publish duration.
+func (ie *ImageExtractor) removeStaleCheckpoints() error {
+	for _, dir := range []string{copyDir, tempDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			key := strings.SplitN(entry.Name(), "+", 2)[0]
+			if time.Since(getCheckpointTime(key)) > ie.config.MaxPublishDuration {
+				glog.V(4).Infof("removing stale checkpoint %s\n", path.Join(dir, entry.Name()))
+				os.RemoveAll(path.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+// getCheckpointTime returns the time the checkpoint of the store key has been
+// modified last. Blobs are written to the root of the copy and renamed to the
+// blobs directory, layers applied are recorded in the checkpoint file.
+func getCheckpointTime(key string) time.Time {
+	var modified time.Time
+	for _, name := range []string{
+		path.Join(copyDir, key),
+		path.Join(copyDir, key, "blobs", digest.Canonical.String()),
+		path.Join(tempDir, key),
+		path.Join(tempDir, key+"+layers"),
+	} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified
+}
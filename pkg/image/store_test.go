@@ -0,0 +1,98 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateInitialStore(t *testing.T) {
+	storeDir := t.TempDir()
+	progressDir = path.Join(storeDir, "inprogress")
+	requestDir = path.Join(storeDir, "request")
+	copyDir = path.Join(storeDir, "copy")
+	digestDir = path.Join(storeDir, "digest")
+	historyDir = path.Join(storeDir, "history")
+	resolveDir = path.Join(storeDir, "resolve")
+	for _, dir := range []string{progressDir, requestDir, copyDir, digestDir, historyDir, resolveDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The initial layout touched empty request and lock files keyed by the
+	// image name with '/' replaced by '_' and linked digest/<image name>/<digest>
+	const digest = "790b52558236313f0939403be37e5e5e7c767602975ba3f740ad887a3e28f1ed"
+	touch := func(fileName string) {
+		if err := os.WriteFile(fileName, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(path.Join(requestDir, "busybox"))
+	touch(path.Join(requestDir, "registry.example.com_my_org_app:1"))
+	touch(path.Join(progressDir, "registry.example.com_my_org_app:1"))
+	touch(path.Join(progressDir, "Invalid"))
+	linkDir := path.Join(digestDir, "registry.example.com/my_org/app:1")
+	if err := os.MkdirAll(linkDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path.Join(storeDir, "extract", digest), path.Join(linkDir, digest)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateStore(storeDir, time.Hour, time.Hour); err != nil {
+		t.Fatalf("migrating store failed %s", err.Error())
+	}
+
+	for _, name := range []string{"docker.io/library/busybox:latest", "registry.example.com/my_org/app:1"} {
+		image := ContainerImage{Name: name}
+		matches, err := filepath.Glob(path.Join(requestDir, image.getFileName()+"+*"))
+		if err != nil || len(matches) != 1 {
+			t.Fatalf("request history of %s not migrated: %v", name, matches)
+		}
+		content, err := os.ReadFile(matches[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(strings.TrimSpace(string(content)), " "+name) {
+			t.Errorf("request history of %s = %q", name, content)
+		}
+	}
+
+	image := ContainerImage{Name: "registry.example.com/my_org/app:1"}
+	// The lock records no digest, the digest linked by the initial layout is
+	// taken
+	if _, err := os.Stat(ContainerImage{Digest: digest}.getLockFileName()); err != nil {
+		t.Errorf("lock of %s not migrated: %s", image.Name, err.Error())
+	}
+	if _, err := os.Lstat(path.Join(image.getDigestDestination(), digest)); err != nil {
+		t.Errorf("digest link of %s not migrated: %s", image.Name, err.Error())
+	}
+	entries, err := os.ReadDir(progressDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("locks left after migration: %d", len(entries))
+	}
+	if version, err := getStoreVersion(storeDir); err != nil || version != storeVersion {
+		t.Errorf("store version = %d, want %d", version, storeVersion)
+	}
+}
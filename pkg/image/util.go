@@ -17,6 +17,7 @@ package image
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,7 +28,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
 	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type ContainerImage struct {
@@ -35,20 +42,103 @@ type ContainerImage struct {
 	Digest string
 }
 
-func NewContainerImage(image string) (*ContainerImage, error) {
-	digest, err := getImageDigest(image)
+func NewContainerImage(ctx context.Context, image string) (*ContainerImage, error) {
+	image, err := normalizeImageName(image)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid image %s", err.Error())
+	}
+	digest, err := getImageDigest(ctx, image)
 	if err != nil {
 		return nil, err
 	}
-	return &ContainerImage{
+	containerImage := &ContainerImage{
 		Name:   image,
 		Digest: digest,
+	}
+	if err := containerImage.recordDigestHistory(); err != nil {
+		glog.V(4).Infof("recording digest history of %s failed %s\n", image, err.Error())
+	}
+	if err := containerImage.recordResolution(); err != nil {
+		glog.V(4).Infof("caching resolution of %s failed %s\n", image, err.Error())
+	}
+	return containerImage, nil
+}
+
+// newPinnedContainerImage returns the image without resolving its tag, as the
+// digest was already resolved when the volume was provisioned.
+func newPinnedContainerImage(image string, pinnedDigest string) (*ContainerImage, error) {
+	image, err := normalizeImageName(image)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid image %s", err.Error())
+	}
+	idx := strings.Index(pinnedDigest, ":")
+	if idx < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "digest %s malformed", pinnedDigest)
+	}
+	return &ContainerImage{
+		Name:   image,
+		Digest: pinnedDigest[idx+1:],
 	}, nil
 }
 
-func (image ContainerImage) isExtracted() bool {
+// containerImageFromContext returns the image of the volume. Persistent
+// volumes provisioned by CreateVolume carry their pinned digest, the tags of
+// all others are resolved according to their pull policy.
+func (ie *ImageExtractor) containerImageFromContext(ctx context.Context, volumeContext map[string]string) (*ContainerImage, error) {
+	image := volumeContext[imageAttribute]
+	if pinnedDigest, ok := volumeContext[pinnedDigestAttribute]; ok {
+		return newPinnedContainerImage(image, pinnedDigest)
+	}
+	if ie.config.TrustDigestReferences {
+		// Fully pinned references are accepted without registry roundtrip
+		if containerImage := getDigestReferenceImage(image); containerImage != nil {
+			return containerImage, verifyExpectedDigest(containerImage, volumeContext[digestAttribute])
+		}
+	}
+
+	pullPolicy := volumeContext[pullPolicyAttribute]
+	if pullPolicy == "" {
+		pullPolicy = ie.config.PullPolicy
+	}
+	containerImage, err := ie.resolveContainerImage(ctx, image, pullPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedDigest := volumeContext[digestAttribute]
+	if err := verifyExpectedDigest(containerImage, expectedDigest); err != nil && pullPolicy == pullPolicyIfNotPresent {
+		// The cached resolution might be outdated
+		glog.V(4).Infof("%s, resolving again\n", err.Error())
+		if containerImage, err = ie.newContainerImage(ctx, image); err != nil {
+			return nil, err
+		}
+	}
+	return containerImage, verifyExpectedDigest(containerImage, expectedDigest)
+}
+
+// verifyExpectedDigest ensures that the image resolved to the digest stated
+// in the volume attributes, if any.
+func verifyExpectedDigest(image *ContainerImage, expectedDigest string) error {
+	if expectedDigest == "" {
+		return nil
+	}
+	expected, err := digest.Parse(expectedDigest)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid %s %s: %s", digestAttribute, expectedDigest, err.Error())
+	}
+	if expected.String() != image.getFullDigest() {
+		return status.Errorf(codes.FailedPrecondition, "image %s resolves to %s instead of expected %s", image.Name, image.getFullDigest(), expected)
+	}
+	return nil
+}
+
+func (image ContainerImage) getFullDigest() string {
+	return fmt.Sprintf("sha256:%s", image.Digest)
+}
+
+func (ie *ImageExtractor) isExtracted(ctx context.Context, image *ContainerImage) bool {
 	//TODO Check digest for updates
-	if inProgess, _ := image.isPullInProgress(); inProgess {
+	if inProgess, _ := ie.isPullInProgress(ctx, image); inProgess {
 		return false
 	}
 	if _, err := os.Stat(image.getExtractDestination()); os.IsNotExist(err) {
@@ -57,39 +147,90 @@ func (image ContainerImage) isExtracted() bool {
 	return true
 }
 
-func (image ContainerImage) isPullInProgress() (bool, time.Time) {
-	var lastModified time.Time
-	if file, err := os.Stat(image.getLockFileName()); !os.IsNotExist(err) {
-		lastModified = file.ModTime()
-	}
-
-	return !lastModified.IsZero(), lastModified
-}
-
-func (image ContainerImage) recordImageRequest() error {
+func (image ContainerImage) recordImageRequest(window time.Duration) error {
 	// Ensure request dir
 	if err := os.MkdirAll(requestDir, os.ModePerm); err != nil {
 		return err
 	}
 
-	// Document last request time for the requested image
-	return touchFile(image.getRequestFileName(), true)
+	// Document the request in the request history of the image
+	file, err := os.OpenFile(image.getRequestFileName(getRequestPeriod(time.Now(), window)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s\n", time.Now().Format(time.RFC3339Nano), image.Name)
+	return err
+}
+
+// recordImageUse updates the modification time of the extraction, which
+// is considered by the garbage collection.
+func (image ContainerImage) recordImageUse() error {
+	currentTime := time.Now().Local()
+	return os.Chtimes(image.getExtractDestination(), currentTime, currentTime)
+}
+
+// normalizeImageName returns the canonical reference of the image, e.g.
+// docker.io/library/busybox:latest for busybox.
+func normalizeImageName(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	return reference.TagNameOnly(named).String(), nil
 }
 
+// getFileName returns the key of the image in the store.
 func (image ContainerImage) getFileName() string {
-	return strings.ReplaceAll(image.Name, "/", "_")
+	return encodeStoreKey(image.Name)
+}
+
+// encodeStoreKey encodes the image name into a single path element. Any byte
+// besides lower case letters, digits, '.' and '-' is escaped as '_' followed
+// by its hex value, so that distinct names never share a key. Keys never
+// contain '+', which therefore separates keys from suffixes in the store.
+func encodeStoreKey(name string) string {
+	var key strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '.' || c == '-' {
+			key.WriteByte(c)
+		} else {
+			fmt.Fprintf(&key, "_%02x", c)
+		}
+	}
+	return key.String()
+}
+
+// getPullKey returns the key of the pull of the image in the store. Pulls are
+// keyed by digest, image names sharing a digest share the pull, while the pull
+// of a new digest of a tag does not wait for the pull of the previous one.
+func (image ContainerImage) getPullKey() string {
+	return image.Digest
 }
 
 func (image ContainerImage) getLockFileName() string {
-	return path.Join(progressDir, image.getFileName())
+	return path.Join(progressDir, image.getPullKey())
 }
 
-func (image ContainerImage) getRequestFileName() string {
-	return path.Join(requestDir, image.getFileName())
+// getRequestFileName returns the request history of the image within the
+// given period. The history is rotated per period and only ever appended to,
+// periods outside the prefetch window are removed as a whole.
+func (image ContainerImage) getRequestFileName(period int64) string {
+	return path.Join(requestDir, fmt.Sprintf("%s+%d", image.getFileName(), period))
+}
+
+// getRequestPeriod returns the period of the request history the time falls
+// into, periods are as long as the prefetch window.
+func getRequestPeriod(t time.Time, window time.Duration) int64 {
+	if window <= 0 {
+		return 0
+	}
+	return t.UnixNano() / int64(window)
 }
 
 func (image ContainerImage) getCopyDestination() string {
-	return path.Join(copyDir, image.Name)
+	return path.Join(copyDir, image.getPullKey())
 }
 
 func (image ContainerImage) getExtractDestination() string {
@@ -97,30 +238,35 @@ func (image ContainerImage) getExtractDestination() string {
 }
 
 func (image ContainerImage) getDigestDestination() string {
-	return path.Join(digestDir, image.Name)
+	return path.Join(digestDir, image.getFileName())
 }
 
+// cleanup removes the leftovers of a pull taken over, which cannot be
+// continued: blobs partially downloaded into the copy, an extraction in the
+// temp dir without checkpoint and an incomplete extraction of an older
+// version of the driver, which extracted in place. Checkpoints and complete
+// extractions are kept. The caller must hold the lock of the pull.
 func (image ContainerImage) cleanup() {
-	os.Remove(image.getLockFileName())
-	os.RemoveAll(image.getCopyDestination())
-	os.RemoveAll(image.getExtractDestination())
+	removeIncompleteBlobs(image.getCopyDestination())
+	if _, err := image.readCheckpoint(); err != nil {
+		os.RemoveAll(image.getExtractTempDestination())
+	}
+	if !image.hasCompleteExtraction() {
+		os.RemoveAll(image.getExtractDestination())
+	}
 }
 
-func getImageDigest(image string) (string, error) {
+func getImageDigest(ctx context.Context, image string) (string, error) {
 	source := fmt.Sprintf("docker://%s", image)
-	args := []string{"inspect"}
-	authFile := os.Getenv("REGISTRY_AUTH_FILE")
-	if authFile != "" {
-		args = append(args, "--authfile", authFile)
-	}
-	args = append(args, source)
-	// TODO Check whether we can use github.com/containers/image/v5 for that
-	cmd := exec.Command("/bin/skopeo", args...)
+	cmd := skopeoCommand(ctx, "inspect", source)
 	stdoutStderr, err := cmd.CombinedOutput()
 	glog.V(6).Infof("skopeo inspect image %s: %s\n", image, stdoutStderr)
 	if err != nil {
 		glog.V(4).Infof("skopeo inspect %s failed %s\n", image, err.Error())
-		return "", err
+		if ctx.Err() != nil {
+			return "", status.FromContextError(ctx.Err()).Err()
+		}
+		return "", classifyPullError(err, stdoutStderr)
 	} else {
 		type Inspect struct {
 			Digest string
@@ -129,18 +275,94 @@ func getImageDigest(image string) (string, error) {
 		err := json.Unmarshal([]byte(stdoutStderr), &inspect)
 		if err != nil {
 			glog.V(4).Infof("unmarshal inspect for %s failed %s\n", image, err.Error())
-			return "", err
+			return "", status.Errorf(codes.Internal, "unmarshal inspect for %s failed %s", image, err.Error())
 		}
 		// Digest "sha256:790b52558236313f0939403be37e5e5e7c767602975ba3f740ad887a3e28f1ed"
 		// extract the last part
 		idx := strings.Index(inspect.Digest, ":")
 		if idx < 0 {
-			return "", fmt.Errorf("digest %s malformed", inspect.Digest)
+			return "", status.Errorf(codes.Internal, "digest %s of %s malformed", inspect.Digest, image)
 		}
 		return inspect.Digest[idx+1:], nil
 	}
 }
 
+// skopeoCommand returns the skopeo command, authenticating against the
+// registries with the auth file given by REGISTRY_AUTH_FILE. The command is
+// killed once the context is done.
+func skopeoCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	skopeoArgs := []string{command}
+	authFile := os.Getenv("REGISTRY_AUTH_FILE")
+	if authFile != "" {
+		skopeoArgs = append(skopeoArgs, "--authfile", authFile)
+	}
+	skopeoArgs = append(skopeoArgs, args...)
+	// TODO Check whether we can use github.com/containers/image/v5 for that
+	return exec.CommandContext(ctx, "/bin/skopeo", skopeoArgs...)
+}
+
+// getRepository returns the image name without tag or digest.
+func (image ContainerImage) getRepository() (string, error) {
+	named, err := reference.ParseNormalizedNamed(image.Name)
+	if err != nil {
+		return "", err
+	}
+	return reference.TrimNamed(named).String(), nil
+}
+
+func getRawManifest(ctx context.Context, source string) ([]byte, error) {
+	cmd := skopeoCommand(ctx, "inspect", "--raw", source)
+	stdout, err := cmd.Output()
+	if err != nil {
+		glog.V(4).Infof("skopeo inspect --raw %s failed %s\n", source, err.Error())
+		return nil, err
+	}
+	return stdout, nil
+}
+
+// getImageManifest returns the manifest of the digest of the image. For
+// multi-arch images the manifest of the platform of the driver is returned.
+func (image ContainerImage) getImageManifest(ctx context.Context) (manifest.Manifest, error) {
+	repository, err := image.getRepository()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := getRawManifest(ctx, fmt.Sprintf("docker://%s@%s", repository, image.getFullDigest()))
+	if err != nil {
+		return nil, err
+	}
+	mimeType := manifest.GuessMIMEType(raw)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(raw, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		instance, err := list.ChooseInstance(&types.SystemContext{})
+		if err != nil {
+			return nil, err
+		}
+		raw, err = getRawManifest(ctx, fmt.Sprintf("docker://%s@%s", repository, instance))
+		if err != nil {
+			return nil, err
+		}
+		mimeType = manifest.GuessMIMEType(raw)
+	}
+	return manifest.FromBlob(raw, mimeType)
+}
+
+// getImageSize returns the sum of the (compressed) layer sizes of the image.
+func (image ContainerImage) getImageSize(ctx context.Context) (int64, error) {
+	imageManifest, err := image.getImageManifest(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, layer := range imageManifest.LayerInfos() {
+		size += layer.Size
+	}
+	return size, nil
+}
+
 func touchFile(fileName string, updateTimes bool) error {
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
 		file, err := os.Create(fileName)
@@ -158,13 +380,25 @@ func touchFile(fileName string, updateTimes bool) error {
 	return nil
 }
 
-func extractTarGz(tarball, target string) error {
-	reader, err := os.Open(tarball)
+// extractLayerBlob extracts the layer blob at the given index of the image,
+// the bytes read are counted by the tracker.
+func extractLayerBlob(ctx context.Context, blobPath, target string, tracker *pullTracker, index int) error {
+	file, err := os.Open(blobPath)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
+	defer file.Close()
 
+	if err := extractTarGz(ctx, tracker.startLayer(index, file), target); err != nil {
+		return err
+	}
+	tracker.finishLayer(index)
+	return nil
+}
+
+// extractTarGz extracts the gzipped tarball, it is aborted once the context
+// is done.
+func extractTarGz(ctx context.Context, reader io.Reader, target string) error {
 	uncompressedStream, err := gzip.NewReader(reader)
 	if err != nil {
 		return err
@@ -173,6 +407,9 @@ func extractTarGz(tarball, target string) error {
 
 	tarReader := tar.NewReader(uncompressedStream)
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
@@ -190,11 +427,18 @@ func extractTarGz(tarball, target string) error {
 			}
 
 		case tar.TypeLink, 50:
+			// Layers are applied again after an interrupted extraction
+			if _, err := os.Lstat(path); err == nil {
+				os.RemoveAll(path)
+			}
 			if err := os.Symlink(header.Linkname, path); err != nil {
 				return err
 			}
 
 		case tar.TypeReg, tar.TypeRegA:
+			if info, err := os.Lstat(path); err == nil && !info.Mode().IsRegular() {
+				os.RemoveAll(path)
+			}
 			file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
 			if err != nil {
 				return err
@@ -0,0 +1,85 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeStoreKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"busybox", "busybox"},
+		{"docker.io/library/busybox:latest", "docker.io_2flibrary_2fbusybox_3alatest"},
+		{"a/b", "a_2fb"},
+		{"a_b", "a_5fb"},
+		{"a_2fb", "a_5f2fb"},
+		{"Registry/Name", "_52egistry_2f_4eame"},
+		{"name@sha256:abc", "name_40sha256_3aabc"},
+		{"a+b", "a_2bb"},
+	}
+	keys := map[string]string{}
+	for _, test := range tests {
+		key := encodeStoreKey(test.name)
+		if key != test.key {
+			t.Errorf("encodeStoreKey(%q) = %q, want %q", test.name, key, test.key)
+		}
+		if strings.ContainsAny(key, "/+") {
+			t.Errorf("encodeStoreKey(%q) = %q contains a reserved character", test.name, key)
+		}
+		if other, ok := keys[key]; ok {
+			t.Errorf("encodeStoreKey(%q) collides with %q", test.name, other)
+		}
+		keys[key] = test.name
+	}
+}
+
+func TestNormalizeImageName(t *testing.T) {
+	digest := "sha256:790b52558236313f0939403be37e5e5e7c767602975ba3f740ad887a3e28f1ed"
+	tests := []struct {
+		image      string
+		normalized string
+		fails      bool
+	}{
+		{image: "busybox", normalized: "docker.io/library/busybox:latest"},
+		{image: "docker.io/busybox", normalized: "docker.io/library/busybox:latest"},
+		{image: "docker.io/library/busybox:latest", normalized: "docker.io/library/busybox:latest"},
+		{image: "busybox:1.36", normalized: "docker.io/library/busybox:1.36"},
+		{image: "user/app", normalized: "docker.io/user/app:latest"},
+		{image: "registry:5000/name:tag", normalized: "registry:5000/name:tag"},
+		{image: "registry.example.com/a/b/c", normalized: "registry.example.com/a/b/c:latest"},
+		{image: "busybox@" + digest, normalized: "docker.io/library/busybox@" + digest},
+		{image: "", fails: true},
+		{image: "Busybox", fails: true},
+		{image: "busybox:in valid", fails: true},
+	}
+	for _, test := range tests {
+		normalized, err := normalizeImageName(test.image)
+		if test.fails {
+			if err == nil {
+				t.Errorf("normalizeImageName(%q) = %q, want error", test.image, normalized)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeImageName(%q) failed %s", test.image, err.Error())
+		} else if normalized != test.normalized {
+			t.Errorf("normalizeImageName(%q) = %q, want %q", test.image, normalized, test.normalized)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+func (ie *ImageExtractor) runWarmer() {
+	for {
+		ie.warmImages()
+		time.Sleep(ie.config.WarmInterval)
+	}
+}
+
+// warmImages resolves the images of the warm list and pulls them into the
+// store, so that consumers find them already extracted.
+func (ie *ImageExtractor) warmImages() {
+	images, err := ie.getWarmImages()
+	if err != nil {
+		glog.Errorf("reading warm images failed %s", err.Error())
+	}
+	for _, image := range images {
+		containerImage, err := ie.newContainerImage(ie.ctx, image)
+		if err != nil {
+			glog.V(4).Infof("resolving warm image %s failed %s\n", image, err.Error())
+			continue
+		}
+		if err := ie.setupImage(ie.ctx, containerImage, nil); err != nil {
+			glog.V(4).Infof("warming image %s: %s\n", image, err.Error())
+		}
+	}
+}
+
+// getWarmImages returns the images given by flag and the ones listed in the
+// warm images file. The file is read on every run to pick up changes.
+func (ie *ImageExtractor) getWarmImages() ([]string, error) {
+	images := append([]string{}, ie.config.WarmImages...)
+	if ie.config.WarmImagesFile == "" {
+		return images, nil
+	}
+
+	file, err := os.Open(ie.config.WarmImagesFile)
+	if err != nil {
+		return images, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	return images, scanner.Err()
+}